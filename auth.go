@@ -0,0 +1,95 @@
+package erwscascade
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+	注册鉴权: 下级平台使用与 cid 绑定的密钥对 cid、时间戳、随机数做 HMAC-SHA256 签名,
+	通过请求头发送给上级平台, 上级平台校验通过后才建立 ws 链接
+**/
+
+const (
+	HeaderTimestamp = "X-Erwscascade-Timestamp"
+	HeaderNonce     = "X-Erwscascade-Nonce"
+	HeaderSign      = "X-Erwscascade-Sign"
+)
+
+// 签名时间戳允许的最大偏差，同时也是 nonce 的缓存时间
+const authWindow = 5 * time.Minute
+
+var usedNonces = make(map[string]time.Time)
+var usedNoncesLock sync.Mutex
+
+func signRegister(secret, cid, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(cid + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 生成注册请求的鉴权头
+func registerAuthHeader(secret, cid string) http.Header {
+	header := make(http.Header)
+	if secret == "" {
+		return header
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderNonce, nonce)
+	header.Set(HeaderSign, signRegister(secret, cid, timestamp, nonce))
+	return header
+}
+
+// 校验注册请求，未配置 auth 时不鉴权
+func (p *ErWsCascadeConfig) verifyRegister(cid string, r *http.Request) error {
+	if len(p.Auth) == 0 {
+		return nil
+	}
+	secret, ok := p.Auth[cid]
+	if !ok || secret == "" {
+		return errors.New("unknown cid")
+	}
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	sign := r.Header.Get(HeaderSign)
+	if timestamp == "" || nonce == "" || sign == "" {
+		return errors.New("missing auth header")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > authWindow || d < -authWindow {
+		return errors.New("timestamp expired")
+	}
+	expected := signRegister(secret, cid, timestamp, nonce)
+	if !hmac.Equal([]byte(expected), []byte(sign)) {
+		return errors.New("invalid sign")
+	}
+
+	// 防重放
+	usedNoncesLock.Lock()
+	defer usedNoncesLock.Unlock()
+	now := time.Now()
+	for n, t := range usedNonces {
+		if now.Sub(t) > authWindow {
+			delete(usedNonces, n)
+		}
+	}
+	if _, used := usedNonces[cid+nonce]; used {
+		return errors.New("nonce reused")
+	}
+	usedNonces[cid+nonce] = now
+	return nil
+}
@@ -0,0 +1,72 @@
+package erwscascade
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedHeader(secret, cid string, at time.Time, nonce string) http.Header {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	header := make(http.Header)
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderNonce, nonce)
+	header.Set(HeaderSign, signRegister(secret, cid, timestamp, nonce))
+	return header
+}
+
+func TestVerifyRegister(t *testing.T) {
+	p := &ErWsCascadeConfig{Auth: map[string]string{"c001": "secret", "c002": ""}}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		cid     string
+		header  http.Header
+		wantErr bool
+	}{
+		{"valid", "c001", registerAuthHeader("secret", "c001"), false},
+		{"unknown cid", "c003", registerAuthHeader("secret", "c003"), true},
+		{"empty secret", "c002", registerAuthHeader("x", "c002"), true},
+		{"missing header", "c001", http.Header{}, true},
+		{"wrong secret", "c001", registerAuthHeader("other", "c001"), true},
+		{"signed for other cid", "c001", registerAuthHeader("secret", "c002"), true},
+		{"inside window", "c001", signedHeader("secret", "c001", now.Add(-authWindow+time.Minute), "n-inside"), false},
+		{"expired", "c001", signedHeader("secret", "c001", now.Add(-authWindow-time.Minute), "n-expired"), true},
+		{"future", "c001", signedHeader("secret", "c001", now.Add(authWindow+time.Minute), "n-future"), true},
+		{"invalid timestamp", "c001", http.Header{HeaderTimestamp: {"abc"}, HeaderNonce: {"n"}, HeaderSign: {"s"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/erwscascade/wsocket/register", nil)
+			r.Header = tt.header
+			if err := p.verifyRegister(tt.cid, r); (err != nil) != tt.wantErr {
+				t.Fatalf("verifyRegister() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyRegisterReplay(t *testing.T) {
+	p := &ErWsCascadeConfig{Auth: map[string]string{"c001": "secret"}}
+	header := registerAuthHeader("secret", "c001")
+	for i, wantErr := range []bool{false, true} {
+		r := httptest.NewRequest(http.MethodGet, "/erwscascade/wspush/live/test", nil)
+		r.Header = header
+		if err := p.verifyRegister("c001", r); (err != nil) != wantErr {
+			t.Fatalf("request %d: error = %v, wantErr %v", i, err, wantErr)
+		}
+	}
+}
+
+func TestVerifyRegisterDisabled(t *testing.T) {
+	p := &ErWsCascadeConfig{}
+	r := httptest.NewRequest(http.MethodGet, "/erwscascade/wsocket/register", nil)
+	if err := p.verifyRegister("any", r); err != nil {
+		t.Fatalf("verifyRegister() without auth = %v", err)
+	}
+	if h := registerAuthHeader("", "c001"); len(h) != 0 {
+		t.Fatalf("registerAuthHeader() without secret = %v", h)
+	}
+}
@@ -0,0 +1,49 @@
+package erwscascade
+
+import (
+	"math/rand"
+	"time"
+)
+
+// 重连退避配置
+type BackoffConfig struct {
+	Min time.Duration `default:"1s" desc:"首次重连等待时间" yaml:"min"`
+	Max time.Duration `default:"60s" desc:"重连最大等待时间" yaml:"max"`
+}
+
+// 指数退避，等待时间每次翻倍直到 Max，并在 [d/2, d) 范围内随机抖动，避免大量下级平台同时重连
+type backoff struct {
+	BackoffConfig
+	attempt int
+}
+
+func newBackoff(cfg BackoffConfig) *backoff {
+	return &backoff{BackoffConfig: cfg}
+}
+
+// 下一次重连前的等待时间
+func (b *backoff) Next() time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	d := min
+	for i := 0; i < b.attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	} else {
+		b.attempt++
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// 连接成功后重置
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
@@ -0,0 +1,45 @@
+package erwscascade
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  BackoffConfig
+		want []time.Duration // 每次的上限，实际等待时间在 [d/2, d] 内
+	}{
+		{"double until max", BackoffConfig{Min: time.Second, Max: 8 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second, 8 * time.Second}},
+		{"max not power of two", BackoffConfig{Min: time.Second, Max: 5 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{"zero min", BackoffConfig{Max: 4 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}},
+		{"max below min", BackoffConfig{Min: 3 * time.Second, Max: time.Second},
+			[]time.Duration{3 * time.Second, 3 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBackoff(tt.cfg)
+			for i, d := range tt.want {
+				got := b.Next()
+				if got < d/2 || got > d {
+					t.Fatalf("Next() #%d = %v, want in [%v, %v]", i, got, d/2, d)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := newBackoff(BackoffConfig{Min: time.Second, Max: time.Minute})
+	for i := 0; i < 10; i++ {
+		b.Next()
+	}
+	b.Reset()
+	if got := b.Next(); got < time.Second/2 || got > time.Second {
+		t.Fatalf("Next() after Reset = %v, want in [500ms, 1s]", got)
+	}
+}
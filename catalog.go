@@ -0,0 +1,215 @@
+package erwscascade
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	流目录同步: 下级平台注册后发送完整流列表(Catalog), 之后本地流发布/关闭时发送增量事件(CatalogEvent),
+	上级平台按 cid 缓存, streamlist 直接从缓存返回
+	下级平台为每个上级平台排队发送目录, 不阻塞引擎事件; 队列满或重连后丢弃排队的事件, 改为发送完整目录
+**/
+
+// 每个上级平台排队的目录事件数
+const catalogQueue = 64
+
+const (
+	CatalogPublish   = "publish"
+	CatalogUnpublish = "unpublish"
+)
+
+// CatalogEvent 的 Pad
+type CatalogEventMessage struct {
+	Action string          `json:"action"`
+	Stream CascadingStream `json:"stream"`
+}
+
+// 上级平台缓存的下级平台流目录
+type clientCatalog struct {
+	sync.RWMutex
+	streams   map[string]*CascadingStream
+	updatedAt time.Time
+	synced    bool // 是否收到过完整目录，老版本下级平台不会发送
+}
+
+func (c *clientCatalog) reset(ss []*CascadingStream) {
+	c.Lock()
+	defer c.Unlock()
+	c.streams = make(map[string]*CascadingStream, len(ss))
+	for _, s := range ss {
+		c.streams[s.StreamPath] = s
+	}
+	c.updatedAt = time.Now()
+	c.synced = true
+}
+
+func (c *clientCatalog) apply(event *CatalogEventMessage) {
+	c.Lock()
+	defer c.Unlock()
+	if c.streams == nil {
+		c.streams = make(map[string]*CascadingStream)
+	}
+	switch event.Action {
+	case CatalogPublish:
+		stream := event.Stream
+		c.streams[stream.StreamPath] = &stream
+	case CatalogUnpublish:
+		delete(c.streams, event.Stream.StreamPath)
+	}
+	c.updatedAt = time.Now()
+}
+
+// 返回目录快照，未同步过时 ok 为 false
+func (c *clientCatalog) snapshot() (ss []*CascadingStream, updatedAt time.Time, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.synced {
+		return nil, time.Time{}, false
+	}
+	ss = make([]*CascadingStream, 0, len(c.streams))
+	for _, s := range c.streams {
+		ss = append(ss, s)
+	}
+	return ss, c.updatedAt, true
+}
+
+// 上级平台: 处理下级平台的目录消息
+func (client *WsClientConn) onCatalogMessage(wsMessage CascadingWsMessage) {
+	switch wsMessage.Type {
+	case Catalog:
+		var ss []*CascadingStream
+		if err := json.Unmarshal(wsMessage.Pad, &ss); err != nil {
+			log.Println("Error parsing catalog:", err)
+			return
+		}
+		client.catalog.reset(ss)
+	case CatalogEvent:
+		var event CatalogEventMessage
+		if err := json.Unmarshal(wsMessage.Pad, &event); err != nil {
+			log.Println("Error parsing catalog event:", err)
+			return
+		}
+		client.catalog.apply(&event)
+	}
+}
+
+// 上级平台: 从缓存获取下级平台流列表
+func getClientCatalog(cid string) (ss []*CascadingStream, updatedAt time.Time, ok bool) {
+	connectionsLock.RLock()
+	client, found := clientConnections[cid]
+	connectionsLock.RUnlock()
+	if !found {
+		return
+	}
+	return client.catalog.snapshot()
+}
+
+// 下级平台流列表的响应头: 目录缓存更新时间或请求时间，是否来自目录缓存
+const (
+	HeaderCatalogTime   = "X-Erwscascade-Catalog-Time"
+	HeaderCatalogCached = "X-Erwscascade-Catalog-Cached"
+)
+
+// 上级平台: 返回下级平台流列表，响应内容与本级流列表一致，更新时间放在响应头
+func writeClientCatalog(w http.ResponseWriter, r *http.Request, ss []*CascadingStream, updatedAt time.Time, cached bool) {
+	w.Header().Set(HeaderCatalogTime, updatedAt.Format(time.RFC3339Nano))
+	w.Header().Set(HeaderCatalogCached, strconv.FormatBool(cached))
+	if ss == nil {
+		ss = make([]*CascadingStream, 0)
+	}
+	util.ReturnValue(ss, w, r)
+}
+
+// 下级平台: 发送完整流目录
+func (c *CascadingWsClient) sendCatalog() error {
+	pad, _ := json.Marshal(filterStreams())
+	msgBytes, _ := json.Marshal(CascadingWsMessage{
+		Sn:   nextSn(),
+		Type: Catalog,
+		Pad:  pad,
+	})
+	return c.writeMessage(ws.OpText, msgBytes)
+}
+
+// 下级平台: 目录事件入队，队列满时丢弃，改为重发完整目录
+func (c *CascadingWsClient) queueCatalog(msg []byte) {
+	select {
+	case c.catalogCh <- msg:
+	default:
+		atomic.StoreInt32(&c.catalogResync, 1)
+	}
+}
+
+// 下级平台: 重发完整目录，之前排队的事件已包含在内
+func (c *CascadingWsClient) resyncCatalog() {
+	atomic.StoreInt32(&c.catalogResync, 1)
+	c.queueCatalog(nil)
+}
+
+// 下级平台: 发送排队的目录，链接写阻塞时只影响该上级平台
+func (c *CascadingWsClient) catalogLoop() {
+	for msg := range c.catalogCh {
+		if c.IsClosed {
+			// 重连后发送完整目录
+			continue
+		}
+		var err error
+		if atomic.SwapInt32(&c.catalogResync, 0) == 1 {
+			c.drainCatalog()
+			err = c.sendCatalog()
+		} else if msg != nil {
+			err = c.writeMessage(ws.OpText, msg)
+		}
+		if err != nil {
+			log.Printf("send catalog: %v", err)
+		}
+	}
+}
+
+func (c *CascadingWsClient) drainCatalog() {
+	for {
+		select {
+		case <-c.catalogCh:
+		default:
+			return
+		}
+	}
+}
+
+// 下级平台: 本地流发布/关闭时通知所有上级平台，只发送变化的流
+func (p *ErWsCascadeConfig) notifyCatalog(action string, streamPath string) {
+	stream := CascadingStream{"api", streamPath}
+	if source, ok := pullSource(streamPath); ok {
+		// 配置文件中的拉流始终在目录中
+		if action == CatalogUnpublish {
+			return
+		}
+		stream.Source = source
+	}
+	pad, _ := json.Marshal(CatalogEventMessage{
+		Action: action,
+		Stream: stream,
+	})
+	msgBytes, _ := json.Marshal(CascadingWsMessage{
+		Sn:   nextSn(),
+		Type: CatalogEvent,
+		Pad:  pad,
+	})
+	wsclientsLock.RLock()
+	defer wsclientsLock.RUnlock()
+	for _, client := range wsclients {
+		if client.IsClosed {
+			continue
+		}
+		client.queueCatalog(msgBytes)
+	}
+}
@@ -4,31 +4,58 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
-	"github.com/google/uuid"
+	. "m7s.live/engine/v4"
 )
 
 var wsclients = make(map[string]*CascadingWsClient)
+var wsclientsLock sync.RWMutex
 
 var cSn int = 0
 
 type CascadingWsClient struct {
+	Cc        *ErWsCascadeConfig
 	CInfo     ClientInfo
 	URL       string
+	PushBase  string       // 上级平台 wspush 地址前缀，按需推流时使用
+	Secret    string       // 注册鉴权密钥
+	TLSConfig *tls.Config  // wss 证书校验配置
+	Origin    string       // 本机 api 地址，代理请求相对路径的前缀
+	LocalHTTP *http.Client // 访问本机 api 的客户端
+	Heartbeat HeartbeatConfig
+	Backoff   BackoffConfig
+
+	closedCh chan struct{} // 链接断开通知重连线程
+
+	catalogCh     chan []byte // 排队发送的目录事件，nil 表示发送完整目录
+	catalogResync int32       // 需要重发完整目录
+
+	linkStats // 上级平台链路 RTT 与最后活跃时间
 	Conn      net.Conn
 	IsClosed  bool
 	IsRecving bool
+
+	writeLock sync.Mutex // 并发处理代理请求时串行写 ws 链接
+
+	inflightLock sync.Mutex
+	inflight     map[int]context.CancelFunc // 处理中的代理请求 sn -> 取消函数
+	windows      map[int]chan struct{}      // 分块回传中的代理请求 sn -> 发送窗口
 }
 
 type ProxyMessage struct {
@@ -36,6 +63,37 @@ type ProxyMessage struct {
 	Header http.Header `json:"header"`
 	Method string      `json:"method"`
 	Body   []byte      `json:"body"`
+	Stream bool        `json:"stream"`           // 请求方支持分块回传响应
+	Window int         `json:"window,omitempty"` // 分块回传的发送窗口(块数)，为 0 时不做流控
+}
+
+// HTTPProxyRsp 的 Pad，携带下级平台 http 响应的状态码、响应头与内容
+type ProxyRspMessage struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stream bool        `json:"stream"`           // 为 true 时 Body 为空，内容随后通过 HTTPProxyChunk 分块发送
+	Window int         `json:"window,omitempty"` // 下级平台按该发送窗口分块回传，收到 HTTPProxyAck 后补充
+}
+
+// HTTPProxyAck 的 Pad
+type ProxyAckMessage struct {
+	Chunks int `json:"chunks"` // 上级平台已写出的分块数
+}
+
+// 超过该大小或长度未知的响应使用分块回传
+const proxyStreamThreshold = 512 * 1024
+
+// 分块回传时每个 HTTPProxyChunk 的最大长度
+const proxyChunkSize = 32 * 1024
+
+// 解析 HTTPProxyRsp 的 Pad，兼容老版本下级平台直接回传 body 的情况
+func parseProxyRspMessage(pad []byte) *ProxyRspMessage {
+	var rsp ProxyRspMessage
+	if err := json.Unmarshal(pad, &rsp); err != nil || rsp.Status == 0 {
+		return &ProxyRspMessage{Status: http.StatusOK, Body: pad}
+	}
+	return &rsp
 }
 
 // MessageType 定义枚举类型 MessageType
@@ -45,12 +103,22 @@ const (
 	CInfo MessageType = iota
 	HTTPProxyReq
 	HTTPProxyRsp
+	HTTPProxyChunk  // 分块响应内容，Pad 为原始数据
+	HTTPProxyEnd    // 分块响应结束，Pad 非空时为错误信息
+	HTTPProxyCancel // 上级取消请求(浏览器断开)
+	HTTPProxyAck    // 上级确认已写出的分块，Pad 为 ProxyAckMessage
+	Ping            // 心跳，Pad 为 HeartbeatMessage
+	Pong            // 心跳应答，原样带回 Ping 的 Pad
+	PushReq         // 上级请求下级推流，Pad 为 PushRequest
+	PushRsp         // 推流请求结果，Pad 为 PushResult
+	Catalog         // 下级平台完整流目录，Pad 为 []CascadingStream
+	CatalogEvent    // 下级平台流发布/关闭，Pad 为 CatalogEventMessage
 	// 在此添加更多的枚举成员
 )
 
 func (m MessageType) String() string {
-	types := [...]string{"CInfo", "HTTPProxyReq", "HTTPProxyRsp"}
-	if m < CInfo || m > HTTPProxyRsp {
+	types := [...]string{"CInfo", "HTTPProxyReq", "HTTPProxyRsp", "HTTPProxyChunk", "HTTPProxyEnd", "HTTPProxyCancel", "HTTPProxyAck", "Ping", "Pong", "PushReq", "PushRsp", "Catalog", "CatalogEvent"}
+	if m < CInfo || int(m) >= len(types) {
 		return "Unknown"
 	}
 	return types[m]
@@ -68,20 +136,20 @@ func NewCascadingWsClient(cinfo ClientInfo, url string) *CascadingWsClient {
 		URL:       url,
 		IsClosed:  true,
 		IsRecving: false,
+		inflight:  make(map[int]context.CancelFunc),
+		windows:   make(map[int]chan struct{}),
+		closedCh:  make(chan struct{}, 1),
+		catalogCh: make(chan []byte, catalogQueue),
 	}
 }
 
 func (c *CascadingWsClient) Connect() error {
 	log.Printf("try 2 ws Connect: %v", c.URL)
 
-	// 创建自定义的 TLS 配置
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-
 	// 创建 Dialer
 	dialer := ws.Dialer{
-		TLSConfig: tlsConfig,
+		TLSConfig: c.TLSConfig,
+		Header:    ws.HandshakeHeaderHTTP(registerAuthHeader(c.Secret, c.CInfo.Cid)),
 	}
 	//conn, _, _, err := ws.Dial(context.Background(), c.URL)
 	conn, _, _, err := dialer.Dial(context.Background(), c.URL)
@@ -96,9 +164,20 @@ func (c *CascadingWsClient) Connect() error {
 	return nil
 }
 
+// 串行写 ws 消息
+func (c *CascadingWsClient) writeMessage(op ws.OpCode, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return wsutil.WriteClientMessage(c.Conn, op, data)
+}
+
 func (c *CascadingWsClient) Close() {
 	c.Conn.Close()
 	c.IsClosed = true
+	select {
+	case c.closedCh <- struct{}{}:
+	default:
+	}
 }
 func (c *CascadingWsClient) SendClientInfo() error {
 	infoBytes, _ := json.Marshal(c.CInfo)
@@ -111,7 +190,7 @@ func (c *CascadingWsClient) SendClientInfo() error {
 
 	msgBytes, _ := json.Marshal(msg)
 
-	err := wsutil.WriteClientMessage(c.Conn, ws.OpText, msgBytes)
+	err := c.writeMessage(ws.OpText, msgBytes)
 	if err != nil {
 		return err
 	}
@@ -128,20 +207,24 @@ func (c *CascadingWsClient) Reconnect() error {
 
 	err := c.Connect()
 	if err != nil {
-		//5 秒后重新链接
-		time.Sleep(time.Duration(5) * time.Second)
 		log.Printf("Connect: %v", err)
 		return err
 	}
 
 	log.Printf("connect 2 ws server sucess....")
+	c.reset()
+	go c.keepAlive(c.Conn)
 
 	err = c.SendClientInfo()
 	if err != nil {
 		log.Printf("SendClientInfo: %v", err)
+		c.Close()
 		return err
 	}
 
+	// 完整目录与之后的事件由 catalogLoop 按顺序发送
+	c.resyncCatalog()
+
 	if !c.IsRecving {
 		go c.receiveWsMessages()
 	}
@@ -149,6 +232,24 @@ func (c *CascadingWsClient) Reconnect() error {
 	return nil
 }
 
+// 保持连接，每个上级平台独立重连，失败后指数退避
+func (c *CascadingWsClient) keepConnect() {
+	b := newBackoff(c.Backoff)
+	for {
+		if err := c.Reconnect(); err == nil {
+			b.Reset()
+			// 等待链接断开
+			<-c.closedCh
+			if !c.IsClosed {
+				continue
+			}
+		}
+		delay := b.Next()
+		log.Printf("reconnect %s after %v", c.URL, delay)
+		time.Sleep(delay)
+	}
+}
+
 func (c *CascadingWsClient) onWsProxyMessages(wsMessage CascadingWsMessage, proxyMessage ProxyMessage) error {
 
 	targetURL := proxyMessage.Url
@@ -158,13 +259,28 @@ func (c *CascadingWsClient) onWsProxyMessages(wsMessage CascadingWsMessage, prox
 		proxyMessage.Header,
 		proxyMessage.Method)
 
-	if !strings.HasPrefix(proxyMessage.Url, "http:") {
+	if !strings.HasPrefix(proxyMessage.Url, "http:") && !strings.HasPrefix(proxyMessage.Url, "https:") {
 		//log.Println("字符串以'http:'打头")
-		targetURL = "http://127.0.0.1:8440" + proxyMessage.Url
+		if !strings.HasPrefix(proxyMessage.Url, "/") {
+			targetURL = "/" + targetURL
+		}
+		targetURL = c.Origin + targetURL
 	}
 
+	// 登记取消函数，上级发送 HTTPProxyCancel 或链接断开时终止请求
+	ctx, cancel := context.WithCancel(context.Background())
+	c.inflightLock.Lock()
+	c.inflight[wsMessage.Sn] = cancel
+	c.inflightLock.Unlock()
+	defer func() {
+		c.inflightLock.Lock()
+		delete(c.inflight, wsMessage.Sn)
+		c.inflightLock.Unlock()
+		cancel()
+	}()
+
 	// 发起代理请求
-	req, err := http.NewRequest(proxyMessage.Method, targetURL, bytes.NewBuffer(proxyMessage.Body))
+	req, err := http.NewRequestWithContext(ctx, proxyMessage.Method, targetURL, bytes.NewBuffer(proxyMessage.Body))
 	if err != nil {
 		log.Printf("Error creating HTTP request: %v", err)
 		return err
@@ -173,41 +289,175 @@ func (c *CascadingWsClient) onWsProxyMessages(wsMessage CascadingWsMessage, prox
 		//req.Header = proxyMessage.Header
 		for key, values := range proxyMessage.Header {
 			// 添加自定义的 Header
-			req.Header.Set(key, values[0])
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
 		}
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.LocalHTTP.Do(req)
 	if err != nil {
 		log.Printf("Error sending HTTP request: %v", err)
+		c.sendProxyRsp(wsMessage.Sn, &ProxyRspMessage{
+			Status: http.StatusBadGateway,
+			Body:   []byte(err.Error()),
+		})
 		return err
 	}
 	defer resp.Body.Close()
 
+	// 长度未知或过大的响应分块回传，避免整体读入内存
+	if proxyMessage.Stream && (resp.ContentLength < 0 || resp.ContentLength > proxyStreamThreshold) {
+		return c.streamProxyRsp(ctx, wsMessage.Sn, resp, proxyMessage.Window)
+	}
+
 	// 读取响应内容
 	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Error reading response body: %v", err)
+		c.sendProxyRsp(wsMessage.Sn, &ProxyRspMessage{
+			Status: http.StatusBadGateway,
+			Body:   []byte(err.Error()),
+		})
 		return err
 	}
-	var rspProxyMessage CascadingWsMessage
-	// 将响应内容填充到 CascadingWsProxyMessage 中并返回给服务器端
-	rspProxyMessage.Pad = respBody
-	rspProxyMessage.Sn = wsMessage.Sn
-	rspProxyMessage.Type = HTTPProxyRsp
+
+	// 状态码、响应头与内容一起返回给服务器端
+	return c.sendProxyRsp(wsMessage.Sn, &ProxyRspMessage{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   respBody,
+	})
+}
+
+// 将代理响应填充到 CascadingWsMessage 中并返回给服务器端
+func (c *CascadingWsClient) sendProxyRsp(sn int, rsp *ProxyRspMessage) error {
+	pad, _ := json.Marshal(rsp)
+	rspProxyMessage := CascadingWsMessage{
+		Sn:   sn,
+		Type: HTTPProxyRsp,
+		Pad:  pad,
+	}
 
 	responseJSON, _ := json.Marshal(rspProxyMessage)
-	err = wsutil.WriteClientMessage(c.Conn, ws.OpText, responseJSON)
+	err := c.writeMessage(ws.OpText, responseJSON)
 	if err != nil {
 		log.Printf("Error sending response: %v", err)
-		//延迟10秒
 		return err
 	}
 
 	return nil
 }
 
+// 先回传状态码与响应头，再把响应内容按 HTTPProxyChunk 分块发送，最后发送 HTTPProxyEnd；
+// 请求方指定发送窗口时，未确认的分块达到窗口大小后暂停，等待 HTTPProxyAck
+func (c *CascadingWsClient) streamProxyRsp(ctx context.Context, sn int, resp *http.Response, window int) error {
+	var credit chan struct{}
+	if window > 0 {
+		credit = make(chan struct{}, window)
+		for i := 0; i < window; i++ {
+			credit <- struct{}{}
+		}
+		c.inflightLock.Lock()
+		c.windows[sn] = credit
+		c.inflightLock.Unlock()
+		defer func() {
+			c.inflightLock.Lock()
+			delete(c.windows, sn)
+			c.inflightLock.Unlock()
+		}()
+	}
+
+	err := c.sendProxyRsp(sn, &ProxyRspMessage{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Stream: true,
+		Window: window,
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, proxyChunkSize)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if credit != nil {
+				// 浏览器读取过慢时暂停，直至上级平台确认或取消请求
+				select {
+				case <-credit:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if err = c.sendProxyMessage(sn, HTTPProxyChunk, buf[:n]); err != nil {
+				log.Printf("Error sending chunk: %v", err)
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			return c.sendProxyMessage(sn, HTTPProxyEnd, nil)
+		}
+		if rerr != nil {
+			log.Printf("Error reading response body: %v", rerr)
+			c.sendProxyMessage(sn, HTTPProxyEnd, []byte(rerr.Error()))
+			return rerr
+		}
+	}
+}
+
+func (c *CascadingWsClient) sendProxyMessage(sn int, t MessageType, pad []byte) error {
+	msg := CascadingWsMessage{
+		Sn:   sn,
+		Type: t,
+		Pad:  pad,
+	}
+	msgBytes, _ := json.Marshal(msg)
+	return c.writeMessage(ws.OpText, msgBytes)
+}
+
+// 取消处理中的代理请求
+func (c *CascadingWsClient) cancelProxy(sn int) {
+	c.inflightLock.Lock()
+	cancel, ok := c.inflight[sn]
+	c.inflightLock.Unlock()
+	if ok {
+		log.Printf("cancel proxy request sn:%v", sn)
+		cancel()
+	}
+}
+
+// 上级平台确认已写出的分块，补充发送窗口
+func (c *CascadingWsClient) ackProxy(wsMessage CascadingWsMessage) {
+	var ack ProxyAckMessage
+	if err := json.Unmarshal(wsMessage.Pad, &ack); err != nil {
+		log.Println("Error parsing ProxyAckMessage:", err)
+		return
+	}
+	c.inflightLock.Lock()
+	credit, ok := c.windows[wsMessage.Sn]
+	c.inflightLock.Unlock()
+	if !ok {
+		return
+	}
+	for i := 0; i < ack.Chunks; i++ {
+		select {
+		case credit <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// 链接断开，取消所有处理中的代理请求
+func (c *CascadingWsClient) cancelAllProxy() {
+	c.inflightLock.Lock()
+	for _, cancel := range c.inflight {
+		cancel()
+	}
+	c.inflightLock.Unlock()
+}
+
 func (c *CascadingWsClient) receiveWsMessages() {
 
 	c.IsRecving = true
@@ -245,6 +495,7 @@ func (c *CascadingWsClient) receiveWsMessages() {
 			//continue
 			//断开重连
 			c.Close()
+			c.cancelAllProxy()
 			break
 		}
 
@@ -255,6 +506,7 @@ func (c *CascadingWsClient) receiveWsMessages() {
 			log.Printf("Error decoding message: %v", err)
 			continue
 		}
+		c.touch()
 		// 根据 MessageType 的值解析 Pad 字段为 ProxyMessage
 		var proxyMessage ProxyMessage
 		if wsMessage.Type == HTTPProxyReq {
@@ -264,7 +516,19 @@ func (c *CascadingWsClient) receiveWsMessages() {
 				continue
 			}
 
-			c.onWsProxyMessages(wsMessage, proxyMessage)
+			// 并发处理，避免慢请求阻塞同一链路上的其他请求
+			go c.onWsProxyMessages(wsMessage, proxyMessage)
+		} else if wsMessage.Type == HTTPProxyCancel {
+			c.cancelProxy(wsMessage.Sn)
+		} else if wsMessage.Type == HTTPProxyAck {
+			c.ackProxy(wsMessage)
+		} else if wsMessage.Type == PushReq {
+			go c.onPushReq(wsMessage)
+		} else if wsMessage.Type == Ping {
+			c.onPing()
+			c.writeMessage(ws.OpText, newPongMessage(wsMessage))
+		} else if wsMessage.Type == Pong {
+			c.onPong(wsMessage.Pad)
 		} else {
 			log.Println("MessageType is:", wsMessage.Type.String())
 		}
@@ -272,18 +536,80 @@ func (c *CascadingWsClient) receiveWsMessages() {
 	c.IsRecving = false
 }
 
-func (p *ErWsCascadeConfig) onClientSetup() {
-	cid := p.CInfo.Cid
-	if cid == "" {
-		// 创建一个新的UUID
-		newUUID, err := uuid.NewRandom()
+// 本机 api 地址，优先使用配置，否则按引擎 http 监听地址生成
+func (p *ErWsCascadeConfig) localOrigin() string {
+	if p.Local.Origin != "" {
+		return strings.TrimRight(p.Local.Origin, "/")
+	}
+	scheme, addr := "http", EngineConfig.HTTP.ListenAddr
+	if addr == "" {
+		scheme, addr = "https", EngineConfig.HTTP.ListenAddrTLS
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("invalid http listen addr %q: %v", addr, err)
+		return "http://127.0.0.1:8080"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// 访问本机 api 的 http 客户端，未配置 CA 时仅回环地址(引擎自签名证书)跳过证书校验
+func (p *ErWsCascadeConfig) localHTTPClient(origin string) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: p.Local.InsecureSkipVerify,
+	}
+	if p.Local.CAFile != "" {
+		pem, err := os.ReadFile(p.Local.CAFile)
 		if err != nil {
-			log.Println("生成UUID错误:", err)
-			return
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no valid cert in " + p.Local.CAFile)
 		}
-		// 将UUID转换为字符串形式
-		cid = newUUID.String()
+		tlsConfig.RootCAs = pool
+	} else if isLoopbackOrigin(origin) {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// 本机 api 地址是否为回环地址
+func isLoopbackOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *ErWsCascadeConfig) onClientSetup() {
+	// 未配置 cid 时使用持久化的 cid
+	if err := p.ensureCid(); err != nil {
+		log.Println("生成UUID错误:", err)
+		return
+	}
+	cid := p.CInfo.Cid
+	log.Printf("local cid: %s", cid)
+
+	origin := p.localOrigin()
+	localHTTP, err := p.localHTTPClient(origin)
+	if err != nil {
+		// 只影响代理请求，改用系统根证书校验，注册、推流与心跳照常
+		log.Printf("local api https config: %v, verify with system roots", err)
+		localHTTP = &http.Client{}
 	}
+	log.Printf("local api origin: %s", origin)
 
 	go func() {
 		for idx, s := range p.ServerConfig {
@@ -303,16 +629,26 @@ func (p *ErWsCascadeConfig) onClientSetup() {
 				Host:   host,
 				Path:   s.ConextPath + "/erwscascade/wsocket/register?cid=" + cid,
 			}
+			tlsConfig, err := s.TLSConfig()
+			if err != nil {
+				log.Printf("server %s tls config: %v", s.Host, err)
+				continue
+			}
 			client := NewCascadingWsClient(p.CInfo, u.String())
+			client.Cc = p
+			client.PushBase = (&url.URL{Scheme: protocol, Host: host, Path: s.ConextPath + "/erwscascade/wspush/"}).String()
+			client.TLSConfig = tlsConfig
+			client.Secret = s.Secret
+			client.Origin = origin
+			client.Heartbeat = p.Heartbeat
+			client.LocalHTTP = localHTTP
+			client.Backoff = p.Backoff
+			wsclientsLock.Lock()
 			wsclients[fmt.Sprintf("%d", idx)] = client
+			wsclientsLock.Unlock()
+			// 保持连接，各上级平台互不影响
+			go client.keepConnect()
+			go client.catalogLoop()
 		}
-		// 保持连接
-		for {
-			for _, client := range wsclients {
-				client.Reconnect()
-			}
-			time.Sleep(time.Duration(5) * time.Second)
-		}
-
 	}()
 }
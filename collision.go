@@ -0,0 +1,193 @@
+package erwscascade
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+/**
+	级联流冲突策略: 不同下级平台(或同一下级平台的不同原始流)推送到上级平台同一个 streamPath 时,
+	按插件配置 collision 或推流地址参数 collision(只对已鉴权的推流端生效) 处理:
+	reject   拒绝后来的推流, 推流端不再重连
+	keepfirst 保留先到的推流, 后来的推流端按退避继续重连, 原推流结束后接替
+	takeover 后来的推流顶替原发布者, 原推流端不再重连
+	同一下级平台重连推送同一路流不属于冲突, 接续原发布者; 原连接仍在接收数据时回复 StatusPushBusy, 推流端按退避重连, 原连接失效后接续
+	推流端握手请求头携带 X-Erwscascade-Reply 时, 上级平台在媒体数据之前回复 json 文本消息, 拒绝时随后发送 ws 关闭帧
+**/
+
+const (
+	collisionReject    = "reject"
+	collisionKeepFirst = "keepfirst"
+	collisionTakeover  = "takeover"
+)
+
+// 推流端声明可接收推流应答
+const (
+	HeaderPushReply = "X-Erwscascade-Reply"
+	pushReplyJSON   = "json"
+)
+
+// 推流被拒绝时的 ws 关闭状态码
+const (
+	StatusPushRejected  ws.StatusCode = 4002 // 流已被占用，不再重连
+	StatusPushBusy      ws.StatusCode = 4003 // 流已被占用，按退避重连
+	StatusPushTakenOver ws.StatusCode = 4004 // 被后来的推流顶替，不再重连
+)
+
+// 等待推流应答的时间
+const pushReplyTimeout = 10 * time.Second
+
+// 上级平台对推流的应答
+type PushReply struct {
+	Accept     bool   `json:"accept"`
+	StreamPath string `json:"streamPath"` // 上级平台发布的流
+	Policy     string `json:"policy,omitempty"`
+	Resume     bool   `json:"resume,omitempty"` // 接续原发布者
+	Code       int    `json:"code,omitempty"`   // 拒绝时的 ws 关闭状态码
+	Reason     string `json:"reason,omitempty"`
+	Owner      string `json:"owner,omitempty"` // 占用流的下级平台 cid
+}
+
+func parseCollision(value string) (string, bool) {
+	switch v := strings.ToLower(value); v {
+	case collisionReject, collisionKeepFirst, collisionTakeover:
+		return v, true
+	}
+	return "", false
+}
+
+// 上级平台: 按冲突策略决定是否接受推流，返回需要接续或顶替的原接收端
+func (p *ErWsCascadeConfig) checkCollision(streamPath string, cid string, original string, policy string) (old *WssRecever, reply *PushReply) {
+	reply = &PushReply{Accept: true, StreamPath: streamPath}
+	if old = findResumable(streamPath, cid, original); old != nil {
+		reply.Resume = true
+		return
+	}
+	s := Streams.Get(streamPath)
+	if s == nil || s.Publisher == nil || s.Publisher.IsClosed() {
+		return nil, reply
+	}
+
+	//流已被占用
+	receivedStreamsLock.RLock()
+	rs, ok := receivedStreams[streamPath]
+	if ok {
+		reply.Owner = rs.Cid
+		if s.Publisher == IPublisher(rs.recever) {
+			old = rs.recever
+		}
+	}
+	receivedStreamsLock.RUnlock()
+	// 同一下级平台重连推送同一路流，原连接尚未失效时推流端按退避重连，原连接失效后接续
+	if ok && rs.Cid == cid && rs.Original == original {
+		reply.Accept, reply.Code = false, int(StatusPushBusy)
+		reply.Reason = "previous push of stream " + streamPath + " is still active"
+		return nil, reply
+	}
+	reply.Policy = collisionPolicy(policy, p.Collision)
+	accept, code := collisionAction(reply.Policy)
+	if accept {
+		return
+	}
+	reply.Accept, reply.Code = false, int(code)
+	reply.Reason = "stream " + streamPath + " is already published"
+	return nil, reply
+}
+
+// 推流地址参数优先于插件配置，均无效时拒绝
+func collisionPolicy(query string, config string) string {
+	if v, ok := parseCollision(query); ok {
+		return v
+	}
+	if v, ok := parseCollision(config); ok {
+		return v
+	}
+	return collisionReject
+}
+
+// 流已被占用时按策略决定是否接受推流，拒绝时返回 ws 关闭状态码
+func collisionAction(policy string) (accept bool, code ws.StatusCode) {
+	switch policy {
+	case collisionTakeover:
+		return true, 0
+	case collisionKeepFirst:
+		return false, StatusPushBusy
+	}
+	return false, StatusPushRejected
+}
+
+// 上级平台: 推流端支持时回复推流应答
+func (recever *WssRecever) sendReply(reply *PushReply) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	recever.writeLock.Lock()
+	defer recever.writeLock.Unlock()
+	return wsutil.WriteServerText(*recever.Conn, data)
+}
+
+// 上级平台: 拒绝推流，发送 ws 关闭帧，老版本推流端按关闭帧断开
+func (recever *WssRecever) reject(reply *PushReply) {
+	ErWsCascadePlugin.Error("wspush rejected", zap.String("streamPath", reply.StreamPath), zap.String("cid", recever.Cid),
+		zap.String("policy", reply.Policy), zap.String("owner", reply.Owner))
+	recever.writeLock.Lock()
+	defer recever.writeLock.Unlock()
+	frame := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusCode(reply.Code), reply.Reason))
+	if err := ws.WriteFrame(*recever.Conn, frame); err != nil {
+		ErWsCascadePlugin.Error("wspush reject", zap.Error(err))
+	}
+}
+
+// 上级平台: 关闭原连接并等待读取结束，code 为 0 时不发送关闭帧(原连接可能已断开)
+func (recever *WssRecever) closeAndWait(code ws.StatusCode, reason string) {
+	if recever.Status == 1 {
+		if code != 0 {
+			recever.sendStop(code, reason)
+		}
+		(*recever.Conn).Close()
+	}
+	select {
+	case <-recever.done:
+	case <-time.After(resumeWaitTimeout):
+		recever.Error("wait old connection end timeout")
+	}
+}
+
+// 下级平台: 读取上级平台的推流应答
+func (pusher *WscPusher) readReply(conn net.Conn) (*PushReply, error) {
+	conn.SetReadDeadline(time.Now().Add(pushReplyTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		data, op, err := wsutil.ReadServerData(conn)
+		if err != nil {
+			return nil, err
+		}
+		if op != ws.OpText {
+			continue
+		}
+		reply := new(PushReply)
+		if err := json.Unmarshal(data, reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+}
+
+// 下级平台: 推流被拒绝，按状态码决定是否继续重连
+func (pusher *WscPusher) onReject(reply *PushReply) error {
+	pusher.Error("WscPusher rejected by server", zap.String("streamPath", reply.StreamPath), zap.String("policy", reply.Policy),
+		zap.String("owner", reply.Owner), zap.String("reason", reply.Reason))
+	if ws.StatusCode(reply.Code) != StatusPushBusy {
+		pusher.stopped = true
+	}
+	return errors.New(reply.Reason)
+}
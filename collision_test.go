@@ -0,0 +1,59 @@
+package erwscascade
+
+import (
+	"testing"
+
+	"github.com/gobwas/ws"
+)
+
+func TestParseCollision(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"reject", collisionReject, true},
+		{"keepfirst", collisionKeepFirst, true},
+		{"takeover", collisionTakeover, true},
+		{"TakeOver", collisionTakeover, true},
+		{"", "", false},
+		{"keep-first", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseCollision(tt.value); got != tt.want || ok != tt.ok {
+			t.Errorf("parseCollision(%q) = %q, %v, want %q, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		config string
+		want   string
+		accept bool
+		code   ws.StatusCode
+	}{
+		{"default", "", "", collisionReject, false, StatusPushRejected},
+		{"config reject", "", "reject", collisionReject, false, StatusPushRejected},
+		{"config keepfirst", "", "keepfirst", collisionKeepFirst, false, StatusPushBusy},
+		{"config takeover", "", "takeover", collisionTakeover, true, 0},
+		{"query overrides config", "takeover", "keepfirst", collisionTakeover, true, 0},
+		{"query keepfirst", "keepfirst", "takeover", collisionKeepFirst, false, StatusPushBusy},
+		{"invalid query falls back to config", "bogus", "keepfirst", collisionKeepFirst, false, StatusPushBusy},
+		{"invalid config", "", "bogus", collisionReject, false, StatusPushRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := collisionPolicy(tt.query, tt.config)
+			if policy != tt.want {
+				t.Fatalf("collisionPolicy(%q, %q) = %q, want %q", tt.query, tt.config, policy, tt.want)
+			}
+			accept, code := collisionAction(policy)
+			if accept != tt.accept || code != tt.code {
+				t.Fatalf("collisionAction(%q) = %v, %d, want %v, %d", policy, accept, code, tt.accept, tt.code)
+			}
+		})
+	}
+}
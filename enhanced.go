@@ -0,0 +1,193 @@
+package erwscascade
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	Enhanced FLV(enhanced-rtmp): HEVC、AV1、Opus 使用 ExHeader + FourCC
+	推流端在 ws 握手请求头中声明支持，上级平台在握手应答中回复同样的请求头后才发送 Enhanced FLV，
+	老版本上级平台不回复，推流端回退为传统 FLV
+**/
+
+// ws 握手协商 flv 格式的请求头
+const (
+	HeaderFlvFormat   = "X-Erwscascade-Flv"
+	flvFormatEnhanced = "enhanced"
+)
+
+var (
+	fourCCHEVC = [4]byte{'h', 'v', 'c', '1'}
+	fourCCAV1  = [4]byte{'a', 'v', '0', '1'}
+	fourCCOpus = [4]byte{'O', 'p', 'u', 's'}
+)
+
+// 传统 FLV 中引擎使用的非标准 codec id
+const (
+	legacyVideoH265 = 12
+	legacyVideoAV1  = 13
+	legacyAudioOpus = 12
+)
+
+// ExHeader 视频 PacketType
+const (
+	videoPacketSequenceStart = iota
+	videoPacketCodedFrames
+	videoPacketSequenceEnd
+	videoPacketCodedFramesX
+	videoPacketMetadata
+	videoPacketMPEG2TSSequenceStart
+)
+
+// ExHeader 音频 PacketType
+const (
+	audioPacketSequenceStart = iota
+	audioPacketCodedFrames
+)
+
+// 音频 ExHeader 的 SoundFormat
+const audioFormatExHeader = 9
+
+func fourCCValue(fourCC [4]byte) uint32 {
+	return binary.BigEndian.Uint32(fourCC[:])
+}
+
+// ExHeader 中紧随第一个字节的 FourCC
+func exHeaderFourCC(p []byte) (fourCC [4]byte) {
+	if len(p) >= 5 {
+		copy(fourCC[:], p[1:5])
+	}
+	return
+}
+
+// 握手请求头是否声明支持 Enhanced FLV
+func acceptEnhancedFlv(h http.Header) bool {
+	for _, v := range h.Values(HeaderFlvFormat) {
+		for _, f := range strings.Split(v, ",") {
+			if strings.TrimSpace(f) == flvFormatEnhanced {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 传统 FLV 视频(引擎 HEVC/AV1 codec id)转换为 ExHeader，不需要转换时返回 nil
+func enhanceVideo(p []byte) []byte {
+	if len(p) < 5 {
+		return nil
+	}
+	var fourCC [4]byte
+	switch p[0] & 0x0F {
+	case legacyVideoH265:
+		fourCC = fourCCHEVC
+	case legacyVideoAV1:
+		fourCC = fourCCAV1
+	default:
+		return nil
+	}
+	frameType := (p[0] >> 4) & 0x07
+	var packetType byte
+	switch p[1] {
+	case 0:
+		packetType = videoPacketSequenceStart
+	case 1:
+		packetType = videoPacketCodedFrames
+	default:
+		packetType = videoPacketSequenceEnd
+	}
+	out := make([]byte, 0, len(p)+3)
+	out = append(out, 0x80|frameType<<4|packetType)
+	out = append(out, fourCC[:]...)
+	// 只有 HEVC 的 CodedFrames 带 CompositionTime
+	if packetType == videoPacketCodedFrames && fourCC == fourCCHEVC {
+		out = append(out, p[2:5]...)
+	}
+	return append(out, p[5:]...)
+}
+
+// 传统 FLV 音频(引擎 Opus codec id)转换为 ExHeader，不需要转换时返回 nil
+func enhanceAudio(p []byte) []byte {
+	if len(p) < 2 || p[0]>>4 != legacyAudioOpus {
+		return nil
+	}
+	packetType := byte(audioPacketCodedFrames)
+	if p[1] == 0 {
+		packetType = audioPacketSequenceStart
+	}
+	out := make([]byte, 0, len(p)+3)
+	out = append(out, audioFormatExHeader<<4|packetType)
+	out = append(out, fourCCOpus[:]...)
+	return append(out, p[2:]...)
+}
+
+// 按 Enhanced FLV 重写完整的 flv tag(tag 头 + 数据 + PreviousTagSize)，不需要转换时原样返回
+func enhanceFLVTag(data []byte) []byte {
+	if len(data) < 15 {
+		return data
+	}
+	payload := data[11 : len(data)-4]
+	var ex []byte
+	switch data[0] {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		ex = enhanceVideo(payload)
+	case codec.FLV_TAG_TYPE_AUDIO:
+		ex = enhanceAudio(payload)
+	}
+	if ex == nil {
+		return data
+	}
+	size := len(ex)
+	tag := make([]byte, 11, 11+size+4)
+	copy(tag, data[:11])
+	tag[1], tag[2], tag[3] = byte(size>>16), byte(size>>8), byte(size)
+	tag = append(tag, ex...)
+	return binary.BigEndian.AppendUint32(tag, uint32(11+size))
+}
+
+// 上级平台: 规范 ExHeader 视频数据后交给引擎，返回 false 表示丢弃
+func normalizeEnhancedVideo(p []byte) ([]byte, bool) {
+	if len(p) < 5 {
+		return nil, false
+	}
+	packetType := p[0] & 0x0F
+	switch packetType {
+	case videoPacketCodedFramesX:
+		// CompositionTime 为 0 的简写，补全为 CodedFrames
+		out := make([]byte, 0, len(p)+3)
+		out = append(out, p[0]&0xF0|videoPacketCodedFrames)
+		out = append(out, p[1:5]...)
+		if exHeaderFourCC(p) == fourCCHEVC {
+			out = append(out, 0, 0, 0)
+		}
+		return append(out, p[5:]...), true
+	case videoPacketSequenceStart, videoPacketCodedFrames:
+		return p, true
+	default:
+		// SequenceEnd、Metadata 等不需要发布
+		return nil, false
+	}
+}
+
+// 上级平台: 发布 ExHeader 音频(Opus)
+func (recever *WssRecever) writeEnhancedAudio(ts uint32, p []byte) {
+	if fourCC := exHeaderFourCC(p); fourCC != fourCCOpus {
+		recever.Warn("enhanced audio not support", zap.ByteString("fourcc", fourCC[:]))
+		return
+	}
+	if p[0]&0x0F != audioPacketCodedFrames {
+		// OpusHead 不需要发布
+		return
+	}
+	if recever.AudioTrack == nil {
+		recever.AudioTrack = track.NewOpus(recever.Stream, recever.pool)
+	}
+	recever.AudioTrack.WriteRawBytes(ts, util.Buffer(p[5:]))
+}
@@ -0,0 +1,153 @@
+package erwscascade
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+)
+
+func TestEnhanceVideo(t *testing.T) {
+	data := []byte{0, 0, 0, 2, 0xAA, 0xBB}
+	tests := []struct {
+		name   string
+		p      []byte
+		want   []byte
+		fourCC [4]byte
+	}{
+		{"hevc sequence", append([]byte{0x1C, 0, 0, 0, 0}, 1, 2, 3),
+			append([]byte{0x90, 'h', 'v', 'c', '1'}, 1, 2, 3), fourCCHEVC},
+		{"hevc keyframe keeps cts", append([]byte{0x1C, 1, 0, 0, 0x28}, data...),
+			append([]byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0x28}, data...), fourCCHEVC},
+		{"hevc inter frame", append([]byte{0x2C, 1, 0, 0, 0}, data...),
+			append([]byte{0xA1, 'h', 'v', 'c', '1', 0, 0, 0}, data...), fourCCHEVC},
+		{"hevc end of sequence", []byte{0x1C, 2, 0, 0, 0},
+			[]byte{0x92, 'h', 'v', 'c', '1'}, fourCCHEVC},
+		{"av1 frame without cts", append([]byte{0x1D, 1, 0, 0, 0}, data...),
+			append([]byte{0x91, 'a', 'v', '0', '1'}, data...), fourCCAV1},
+		{"h264 unchanged", append([]byte{0x17, 1, 0, 0, 0}, data...), nil, [4]byte{}},
+		{"too short", []byte{0x1C, 1}, nil, [4]byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := enhanceVideo(tt.p)
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("enhanceVideo() = %x, want %x", got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if got[0]&0x80 == 0 || exHeaderFourCC(got) != tt.fourCC {
+				t.Fatalf("ExHeader = %#x %q, want FourCC %q", got[0], exHeaderFourCC(got), tt.fourCC)
+			}
+			if fourCCValue(exHeaderFourCC(got)) != binary.BigEndian.Uint32(tt.fourCC[:]) {
+				t.Fatalf("fourCCValue() mismatch")
+			}
+		})
+	}
+}
+
+func TestEnhanceAudio(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		want []byte
+	}{
+		{"opus sequence", []byte{0xC0, 0, 1, 2}, []byte{0x90, 'O', 'p', 'u', 's', 1, 2}},
+		{"opus frame", []byte{0xC0, 1, 3, 4}, []byte{0x91, 'O', 'p', 'u', 's', 3, 4}},
+		{"aac unchanged", []byte{0xAF, 1, 3, 4}, nil},
+		{"too short", []byte{0xC0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := enhanceAudio(tt.p); !bytes.Equal(got, tt.want) {
+				t.Fatalf("enhanceAudio() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func flvTag(t byte, ts uint32, payload []byte) []byte {
+	tag := []byte{t, byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		byte(ts >> 16), byte(ts >> 8), byte(ts), byte(ts >> 24), 0, 0, 0}
+	tag = append(tag, payload...)
+	return binary.BigEndian.AppendUint32(tag, uint32(11+len(payload)))
+}
+
+// 完整 flv tag 转换后重新解析，tag 长度与 PreviousTagSize 同步更新
+func TestEnhanceFLVTagRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       byte
+		payload []byte
+		want    []byte
+	}{
+		{"hevc", codec.FLV_TAG_TYPE_VIDEO, []byte{0x1C, 1, 0, 0, 0x28, 0xAA}, []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0x28, 0xAA}},
+		{"opus", codec.FLV_TAG_TYPE_AUDIO, []byte{0xC0, 1, 0xBB}, []byte{0x91, 'O', 'p', 'u', 's', 0xBB}},
+		{"h264 unchanged", codec.FLV_TAG_TYPE_VIDEO, []byte{0x17, 1, 0, 0, 0, 0xAA}, []byte{0x17, 1, 0, 0, 0, 0xAA}},
+		{"script unchanged", codec.FLV_TAG_TYPE_SCRIPT, []byte{2, 0, 0}, []byte{2, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := enhanceFLVTag(flvTag(tt.t, 0x01020304, tt.payload))
+			typ, ts, payload, err := readFLVTag(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("readFLVTag() error = %v", err)
+			}
+			if typ != tt.t || ts != 0x01020304 || !bytes.Equal(payload, tt.want) {
+				t.Fatalf("readFLVTag() = %#x, %#x, %x, want %x", typ, ts, payload, tt.want)
+			}
+			if size := binary.BigEndian.Uint32(data[len(data)-4:]); int(size) != len(data)-4 {
+				t.Fatalf("PreviousTagSize = %d, want %d", size, len(data)-4)
+			}
+		})
+	}
+}
+
+func TestNormalizeEnhancedVideo(t *testing.T) {
+	tests := []struct {
+		name string
+		p    []byte
+		want []byte
+		ok   bool
+	}{
+		{"hevc coded frames x", []byte{0x93, 'h', 'v', 'c', '1', 0xAA}, []byte{0x91, 'h', 'v', 'c', '1', 0, 0, 0, 0xAA}, true},
+		{"av1 coded frames x", []byte{0xA3, 'a', 'v', '0', '1', 0xAA}, []byte{0xA1, 'a', 'v', '0', '1', 0xAA}, true},
+		{"sequence start", []byte{0x90, 'h', 'v', 'c', '1', 1}, []byte{0x90, 'h', 'v', 'c', '1', 1}, true},
+		{"sequence end", []byte{0x92, 'h', 'v', 'c', '1'}, nil, false},
+		{"metadata", []byte{0x84, 'h', 'v', 'c', '1', 0}, nil, false},
+		{"too short", []byte{0x91, 'h'}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeEnhancedVideo(tt.p)
+			if ok != tt.ok || !bytes.Equal(got, tt.want) {
+				t.Fatalf("normalizeEnhancedVideo() = %x, %v, want %x, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAcceptEnhancedFlv(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"enhanced"}, true},
+		{[]string{"legacy, enhanced"}, true},
+		{[]string{"legacy", "enhanced"}, true},
+		{[]string{"Enhanced"}, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for _, v := range tt.values {
+			h.Add(HeaderFlvFormat, v)
+		}
+		if got := acceptEnhancedFlv(h); got != tt.want {
+			t.Errorf("acceptEnhancedFlv(%q) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
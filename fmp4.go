@@ -0,0 +1,809 @@
+package erwscascade
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"m7s.live/engine/v4/codec"
+)
+
+/**
+	fMP4(CMAF) 级联媒体格式, 推流地址参数 format=fmp4 选择
+	推流端把订阅到的 flv tag 封装为 init segment(ftyp+moov) 与 media segment(moof+mdat), 每个 ws 消息一个 segment
+	上级平台解封装后转换为 flv tag 发布, 支持 H264、H265、AV1、AAC、Opus、G711
+**/
+
+// fMP4 时间刻度与 flv 一致，单位毫秒
+const fmp4Timescale = 1000
+
+// 单个 mp4 box 最大长度
+const maxMP4BoxSize = 64 * 1024 * 1024
+
+var (
+	fourCCAVC1 = [4]byte{'a', 'v', 'c', '1'}
+	fourCCAVC3 = [4]byte{'a', 'v', 'c', '3'}
+	fourCCHEV1 = [4]byte{'h', 'e', 'v', '1'}
+	fourCCMP4A = [4]byte{'m', 'p', '4', 'a'}
+	fourCCALaw = [4]byte{'a', 'l', 'a', 'w'}
+	fourCCULaw = [4]byte{'u', 'l', 'a', 'w'}
+)
+
+// trun 中的 sample_flags
+const (
+	sampleFlagsKey    = 0x02000000
+	sampleFlagsNonKey = 0x01010000
+)
+
+// flv 音频 SoundFormat
+const (
+	flvAudioPCMA = 7
+	flvAudioPCMU = 8
+	flvAudioAAC  = 10
+)
+
+// flv 视频 CodecID
+const flvVideoH264 = 7
+
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+func mp4Box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{head}, payloads...)...)
+}
+
+// 依次读取 b 中的子 box
+func eachMP4Box(b []byte, fn func(typ string, payload []byte) error) error {
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		typ := string(b[4:8])
+		head := uint64(8)
+		if size == 1 {
+			if len(b) < 16 {
+				return errors.New("mp4 box too short")
+			}
+			size, head = binary.BigEndian.Uint64(b[8:]), 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < head || size > uint64(len(b)) {
+			return errors.New("invalid mp4 box size")
+		}
+		if err := fn(typ, b[head:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// 从字节流读取一个顶层 box，返回 box 头长度
+func readMP4Box(r io.Reader) (typ string, head int, payload []byte, err error) {
+	var h [16]byte
+	if _, err = io.ReadFull(r, h[:8]); err != nil {
+		return
+	}
+	size := uint64(binary.BigEndian.Uint32(h[:]))
+	typ, head = string(h[4:8]), 8
+	if size == 1 {
+		if _, err = io.ReadFull(r, h[8:16]); err != nil {
+			return
+		}
+		size, head = binary.BigEndian.Uint64(h[8:]), 16
+	}
+	if size < uint64(head) || size > maxMP4BoxSize {
+		err = errors.New("invalid mp4 box size")
+		return
+	}
+	payload = make([]byte, size-uint64(head))
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+type fmp4Sample struct {
+	dts  uint64 // 毫秒，flv 时间戳回绕后继续递增
+	cts  int32
+	key  bool
+	data []byte
+}
+
+type fmp4Track struct {
+	id         uint32
+	codec      [4]byte
+	config     []byte
+	channels   uint16
+	sampleRate uint32
+
+	pending  *fmp4Sample // 等待下一帧计算时长
+	duration uint32      // 上一帧时长
+}
+
+// 推流端: flv tag 封装为 fMP4
+type fmp4Muxer struct {
+	video, audio  *fmp4Track
+	width, height uint16
+
+	initSent bool
+	waitKey  bool
+	seq      uint32
+
+	// flv 时间戳为 32 位毫秒(约 49.7 天回绕)，扩展为 64 位写入 tfdt
+	lastTs    uint32
+	tsEpoch   uint64
+	tsStarted bool
+}
+
+// 写入一个 flv tag，返回需要发送的 segment 及其类型(用于发送队列丢帧判断)
+func (m *fmp4Muxer) writeTag(t byte, ts uint32, p []byte, hasVideo, hasAudio bool) (segments [][]byte, kind itemKind) {
+	var tr *fmp4Track
+	var sample *fmp4Sample
+	switch t {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		tr, sample = m.writeVideo(m.extendTs(ts), p)
+	case codec.FLV_TAG_TYPE_AUDIO:
+		tr, sample = m.writeAudio(m.extendTs(ts), p)
+	}
+	if !m.initSent {
+		if (hasVideo && (m.video == nil || m.video.config == nil)) || (hasAudio && m.audio == nil) {
+			return
+		}
+		segments = append(segments, m.initSegment())
+		m.initSent, m.waitKey = true, m.video != nil
+	}
+	if sample == nil {
+		return
+	}
+	if tr == m.video && m.waitKey {
+		if !sample.key {
+			return
+		}
+		m.waitKey = false
+	}
+	if pending := tr.pending; pending != nil {
+		duration := uint32(sample.dts - pending.dts)
+		if sample.dts <= pending.dts || sample.dts-pending.dts > 0xFFFFFFFF {
+			duration = tr.duration
+		}
+		tr.duration = duration
+		// 与 init segment 一起发送时不可丢弃
+		if len(segments) == 0 {
+			kind = itemAudio
+			if tr == m.video {
+				kind = itemVideo
+				if pending.key {
+					kind = itemKeyframe
+				}
+			}
+		}
+		segments = append(segments, m.fragment(tr, pending, duration))
+	}
+	tr.pending = sample
+	return
+}
+
+// 32 位时间戳扩展为 64 位: 向回跳过半个范围视为回绕，向前跳过半个范围视为回绕前的晚到帧
+func (m *fmp4Muxer) extendTs(ts uint32) uint64 {
+	if !m.tsStarted {
+		m.lastTs, m.tsStarted = ts, true
+		return uint64(ts)
+	}
+	switch {
+	case ts < m.lastTs && m.lastTs-ts > 1<<31:
+		m.tsEpoch += 1 << 32
+	case ts > m.lastTs && ts-m.lastTs > 1<<31:
+		if m.tsEpoch == 0 {
+			return uint64(ts)
+		}
+		return m.tsEpoch - 1<<32 + uint64(ts)
+	}
+	m.lastTs = ts
+	return m.tsEpoch + uint64(ts)
+}
+
+// 配置变化时需要重新发送 init segment
+func (m *fmp4Muxer) setConfig(tr *fmp4Track, fourCC [4]byte, config []byte) {
+	if tr.codec != fourCC || string(tr.config) != string(config) {
+		tr.codec, tr.config = fourCC, append([]byte{}, config...)
+		m.reset()
+	}
+}
+
+func (m *fmp4Muxer) reset() {
+	m.initSent = false
+	for _, tr := range []*fmp4Track{m.video, m.audio} {
+		if tr != nil {
+			tr.pending = nil
+		}
+	}
+}
+
+func (m *fmp4Muxer) writeVideo(ts uint64, p []byte) (*fmp4Track, *fmp4Sample) {
+	if len(p) < 5 {
+		return nil, nil
+	}
+	var fourCC [4]byte
+	switch p[0] & 0x0F {
+	case flvVideoH264:
+		fourCC = fourCCAVC1
+	case legacyVideoH265:
+		fourCC = fourCCHEVC
+	case legacyVideoAV1:
+		fourCC = fourCCAV1
+	default:
+		return nil, nil
+	}
+	if m.video == nil {
+		m.video = &fmp4Track{id: 1}
+	}
+	switch p[1] {
+	case 0:
+		m.setConfig(m.video, fourCC, p[5:])
+	case 1:
+		if m.video.config == nil {
+			return nil, nil
+		}
+		cts := int32(uint32(p[2])<<16|uint32(p[3])<<8|uint32(p[4])) << 8 >> 8
+		return m.video, &fmp4Sample{dts: ts, cts: cts, key: p[0]>>4 == 1, data: p[5:]}
+	}
+	return nil, nil
+}
+
+func (m *fmp4Muxer) writeAudio(ts uint64, p []byte) (*fmp4Track, *fmp4Sample) {
+	if len(p) < 2 {
+		return nil, nil
+	}
+	audio := func(fourCC [4]byte, config []byte, sampleRate uint32, channels uint16) {
+		if m.audio == nil {
+			m.audio = &fmp4Track{id: 2}
+		}
+		m.audio.sampleRate, m.audio.channels = sampleRate, channels
+		m.setConfig(m.audio, fourCC, config)
+	}
+	switch p[0] >> 4 {
+	case flvAudioAAC:
+		if p[1] == 0 {
+			sampleRate, channels := parseAudioSpecificConfig(p[2:])
+			audio(fourCCMP4A, p[2:], sampleRate, channels)
+			return nil, nil
+		}
+		if m.audio == nil || m.audio.codec != fourCCMP4A {
+			return nil, nil
+		}
+		return m.audio, &fmp4Sample{dts: ts, key: true, data: p[2:]}
+	case flvAudioPCMA, flvAudioPCMU:
+		fourCC := fourCCALaw
+		if p[0]>>4 == flvAudioPCMU {
+			fourCC = fourCCULaw
+		}
+		audio(fourCC, nil, 8000, 1)
+		return m.audio, &fmp4Sample{dts: ts, key: true, data: p[1:]}
+	case legacyAudioOpus:
+		audio(fourCCOpus, nil, 48000, 2)
+		if p[1] == 0 {
+			return nil, nil
+		}
+		return m.audio, &fmp4Sample{dts: ts, key: true, data: p[2:]}
+	}
+	return nil, nil
+}
+
+// AudioSpecificConfig 中的采样率与声道数
+func parseAudioSpecificConfig(asc []byte) (sampleRate uint32, channels uint16) {
+	sampleRate, channels = 44100, 2
+	if len(asc) < 2 {
+		return
+	}
+	if idx := (asc[0]&0x07)<<1 | asc[1]>>7; int(idx) < len(aacSampleRates) {
+		sampleRate = aacSampleRates[idx]
+	}
+	if c := (asc[1] >> 3) & 0x0F; c > 0 {
+		channels = uint16(c)
+	}
+	return
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+func (m *fmp4Muxer) initSegment() []byte {
+	var traks, trexs [][]byte
+	nextID := uint32(1)
+	for _, tr := range []*fmp4Track{m.video, m.audio} {
+		if tr == nil || (tr == m.video && tr.config == nil) {
+			continue
+		}
+		traks = append(traks, m.trak(tr))
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, u32(tr.id), u32(1), u32(0), u32(0), u32(0)))
+		if tr.id >= nextID {
+			nextID = tr.id + 1
+		}
+	}
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(fmp4Timescale), u32(0), // creation modification timescale duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), mp4Matrix, make([]byte, 24), u32(nextID))
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, mp4Box("mvex", trexs...))
+	ftyp := mp4Box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+	return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func (m *fmp4Muxer) trak(tr *fmp4Track) []byte {
+	isVideo := tr == m.video
+	var volume uint16
+	var width, height uint32
+	handler, name := "soun", "SoundHandler"
+	var mhd, entry []byte
+	if isVideo {
+		handler, name = "vide", "VideoHandler"
+		width, height = uint32(m.width)<<16, uint32(m.height)<<16
+		mhd = mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+		configType := "avcC"
+		switch tr.codec {
+		case fourCCHEVC:
+			configType = "hvcC"
+		case fourCCAV1:
+			configType = "av1C"
+		}
+		compressor := make([]byte, 32)
+		entry = mp4Box(string(tr.codec[:]),
+			make([]byte, 6), u16(1), make([]byte, 16), u16(m.width), u16(m.height),
+			u32(0x00480000), u32(0x00480000), u32(0), u16(1), compressor, u16(0x0018), u16(0xFFFF),
+			mp4Box(configType, tr.config))
+	} else {
+		volume = 0x0100
+		mhd = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+		var config []byte
+		switch tr.codec {
+		case fourCCMP4A:
+			config = esdsBox(tr.config)
+		case fourCCOpus:
+			config = mp4Box("dOps", []byte{0, byte(tr.channels)}, u16(0), u32(tr.sampleRate), u16(0), []byte{0})
+		}
+		sampleRate := tr.sampleRate
+		if sampleRate > 0xFFFF {
+			sampleRate = 0
+		}
+		entry = mp4Box(string(tr.codec[:]),
+			make([]byte, 6), u16(1), make([]byte, 8), u16(tr.channels), u16(16), u16(0), u16(0), u32(sampleRate<<16),
+			config)
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(tr.id), u32(0), u32(0), make([]byte, 8),
+		u16(0), u16(0), u16(volume), u16(0), mp4Matrix, u32(width), u32(height))
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(fmp4Timescale), u32(0), u16(0x55C4), u16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), entry),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mhd, dinf, stbl)))
+}
+
+// AAC 的 esds box
+func esdsBox(asc []byte) []byte {
+	dsi := append([]byte{0x05, byte(len(asc))}, asc...)
+	dcd := append([]byte{0x04, byte(13 + len(dsi)), 0x40, 0x15, 0, 0, 0}, u32(0)...)
+	dcd = append(append(dcd, u32(0)...), dsi...)
+	es := append([]byte{0x03, byte(3 + len(dcd) + 3), 0, 0, 0}, dcd...)
+	es = append(es, 0x06, 0x01, 0x02)
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+// 单帧 moof+mdat
+func (m *fmp4Muxer) fragment(tr *fmp4Track, s *fmp4Sample, duration uint32) []byte {
+	m.seq++
+	flags := uint32(sampleFlagsNonKey)
+	if s.key {
+		flags = sampleFlagsKey
+	}
+	moof := func(dataOffset uint32) []byte {
+		// data-offset、sample-duration、sample-size、sample-flags、sample-composition-time-offset
+		trun := mp4FullBox("trun", 1, 0x000F01,
+			u32(1), u32(dataOffset), u32(duration), u32(uint32(len(s.data))), u32(flags), u32(uint32(s.cts)))
+		// default-base-is-moof
+		tfhd := mp4FullBox("tfhd", 0, 0x020000, u32(tr.id))
+		tfdt := mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, s.dts))
+		return mp4Box("moof", mp4FullBox("mfhd", 0, 0, u32(m.seq)), mp4Box("traf", tfhd, tfdt, trun))
+	}
+	head := moof(0)
+	head = moof(uint32(len(head) + 8))
+	return append(head, mp4Box("mdat", s.data)...)
+}
+
+type fmp4DemuxTrack struct {
+	id        uint32
+	handler   string
+	codec     [4]byte
+	config    []byte
+	timescale uint32
+
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+// 上级平台: fMP4 解封装为 flv tag
+type fmp4Demuxer struct {
+	tracks map[uint32]*fmp4DemuxTrack
+	onTag  func(t byte, ts uint32, payload []byte)
+
+	moof     []byte
+	moofSize int
+}
+
+func newFMP4Demuxer(onTag func(t byte, ts uint32, payload []byte)) *fmp4Demuxer {
+	return &fmp4Demuxer{
+		tracks: make(map[uint32]*fmp4DemuxTrack),
+		onTag:  onTag,
+	}
+}
+
+// 阻塞读取 fMP4 字节流
+func (d *fmp4Demuxer) read(r io.Reader) error {
+	for {
+		typ, head, payload, err := readMP4Box(r)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "moov":
+			if err = d.parseMoov(payload); err != nil {
+				return err
+			}
+		case "moof":
+			d.moof, d.moofSize = payload, head+len(payload)
+		case "mdat":
+			if d.moof != nil {
+				err = d.parseFragment(d.moof, d.moofSize, head, payload)
+				d.moof = nil
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (d *fmp4Demuxer) parseMoov(b []byte) error {
+	tracks := make(map[uint32]*fmp4DemuxTrack)
+	err := eachMP4Box(b, func(typ string, payload []byte) error {
+		switch typ {
+		case "trak":
+			tr, err := parseTrak(payload)
+			if err != nil {
+				return err
+			}
+			tracks[tr.id] = tr
+		case "mvex":
+			return eachMP4Box(payload, func(typ string, payload []byte) error {
+				if typ == "trex" && len(payload) >= 24 {
+					if tr, ok := tracks[binary.BigEndian.Uint32(payload[4:])]; ok {
+						tr.defaultDuration = binary.BigEndian.Uint32(payload[12:])
+						tr.defaultSize = binary.BigEndian.Uint32(payload[16:])
+						tr.defaultFlags = binary.BigEndian.Uint32(payload[20:])
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.tracks = tracks
+	// 发布解码配置
+	for _, tr := range tracks {
+		if tr.config != nil {
+			if t, payload := tr.sequenceTag(); payload != nil {
+				d.onTag(t, 0, payload)
+			}
+		}
+	}
+	return nil
+}
+
+func parseTrak(b []byte) (*fmp4DemuxTrack, error) {
+	tr := &fmp4DemuxTrack{timescale: fmp4Timescale}
+	var walk func(b []byte) error
+	walk = func(b []byte) error {
+		return eachMP4Box(b, func(typ string, payload []byte) error {
+			switch typ {
+			case "mdia", "minf", "stbl":
+				return walk(payload)
+			case "tkhd":
+				if len(payload) >= 24 && payload[0] == 1 {
+					tr.id = binary.BigEndian.Uint32(payload[20:])
+				} else if len(payload) >= 16 {
+					tr.id = binary.BigEndian.Uint32(payload[12:])
+				}
+			case "mdhd":
+				if len(payload) >= 24 && payload[0] == 1 {
+					tr.timescale = binary.BigEndian.Uint32(payload[20:])
+				} else if len(payload) >= 16 {
+					tr.timescale = binary.BigEndian.Uint32(payload[12:])
+				}
+			case "hdlr":
+				if len(payload) >= 12 {
+					tr.handler = string(payload[8:12])
+				}
+			case "stsd":
+				if len(payload) < 8 {
+					return errors.New("invalid stsd")
+				}
+				// 只取第一个 sample entry
+				return eachMP4Box(payload[8:], func(typ string, payload []byte) error {
+					if tr.codec == [4]byte{} {
+						copy(tr.codec[:], typ)
+						tr.parseSampleEntry(payload)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	if err := walk(b); err != nil {
+		return nil, err
+	}
+	if tr.timescale == 0 {
+		return nil, errors.New("invalid mdhd timescale")
+	}
+	return tr, nil
+}
+
+func (tr *fmp4DemuxTrack) parseSampleEntry(b []byte) {
+	offset := 28
+	if tr.handler == "vide" {
+		offset = 78
+	}
+	if len(b) < offset {
+		return
+	}
+	eachMP4Box(b[offset:], func(typ string, payload []byte) error {
+		switch typ {
+		case "avcC", "hvcC", "av1C":
+			tr.config = payload
+		case "esds":
+			if len(payload) > 4 {
+				tr.config = parseESDescriptor(payload[4:])
+			}
+		case "dOps":
+			tr.config = payload
+		}
+		return nil
+	})
+}
+
+// 从 esds 中取出 DecoderSpecificInfo(AudioSpecificConfig)
+func parseESDescriptor(b []byte) []byte {
+	for len(b) > 2 {
+		tag := b[0]
+		var size, i int
+		for i = 1; i < 5 && i < len(b); i++ {
+			size = size<<7 | int(b[i]&0x7F)
+			if b[i]&0x80 == 0 {
+				break
+			}
+		}
+		head := i + 1
+		if head+size > len(b) {
+			return nil
+		}
+		body := b[head : head+size]
+		switch tag {
+		case 0x03:
+			if len(body) < 3 {
+				return nil
+			}
+			flags, skip := body[2], 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > len(body) {
+				return nil
+			}
+			return parseESDescriptor(body[skip:])
+		case 0x04:
+			if len(body) < 13 {
+				return nil
+			}
+			return parseESDescriptor(body[13:])
+		case 0x05:
+			return body
+		}
+		b = b[head+size:]
+	}
+	return nil
+}
+
+func (d *fmp4Demuxer) parseFragment(moof []byte, moofSize int, mdatHead int, mdat []byte) error {
+	return eachMP4Box(moof, func(typ string, payload []byte) error {
+		if typ != "traf" {
+			return nil
+		}
+		var tr *fmp4DemuxTrack
+		var base uint64
+		defaultDuration, defaultSize, defaultFlags := uint32(0), uint32(0), uint32(0)
+		cursor := 0
+		return eachMP4Box(payload, func(typ string, payload []byte) error {
+			if len(payload) < 8 {
+				return nil
+			}
+			flags := binary.BigEndian.Uint32(payload) & 0xFFFFFF
+			switch typ {
+			case "tfhd":
+				tr = d.tracks[binary.BigEndian.Uint32(payload[4:])]
+				if tr == nil {
+					return nil
+				}
+				defaultDuration, defaultSize, defaultFlags = tr.defaultDuration, tr.defaultSize, tr.defaultFlags
+				p := payload[8:]
+				for _, f := range []struct {
+					flag uint32
+					size int
+					v    *uint32
+				}{{0x01, 8, nil}, {0x02, 4, nil}, {0x08, 4, &defaultDuration}, {0x10, 4, &defaultSize}, {0x20, 4, &defaultFlags}} {
+					if flags&f.flag == 0 {
+						continue
+					}
+					if len(p) < f.size {
+						return errors.New("invalid tfhd")
+					}
+					if f.v != nil {
+						*f.v = binary.BigEndian.Uint32(p)
+					}
+					p = p[f.size:]
+				}
+			case "tfdt":
+				if payload[0] == 1 && len(payload) >= 12 {
+					base = binary.BigEndian.Uint64(payload[4:])
+				} else {
+					base = uint64(binary.BigEndian.Uint32(payload[4:]))
+				}
+			case "trun":
+				if tr == nil {
+					return nil
+				}
+				version := payload[0]
+				count := binary.BigEndian.Uint32(payload[4:])
+				p := payload[8:]
+				next := func() (uint32, error) {
+					if len(p) < 4 {
+						return 0, errors.New("invalid trun")
+					}
+					v := binary.BigEndian.Uint32(p)
+					p = p[4:]
+					return v, nil
+				}
+				if flags&0x01 != 0 {
+					offset, err := next()
+					if err != nil {
+						return err
+					}
+					// data offset 相对 moof 起始位置
+					cursor = int(int32(offset)) - moofSize - mdatHead
+				}
+				firstFlags, hasFirstFlags := uint32(0), flags&0x04 != 0
+				if hasFirstFlags {
+					var err error
+					if firstFlags, err = next(); err != nil {
+						return err
+					}
+				}
+				for i := uint32(0); i < count; i++ {
+					duration, size, sampleFlags, cts := defaultDuration, defaultSize, defaultFlags, int32(0)
+					if i == 0 && hasFirstFlags {
+						sampleFlags = firstFlags
+					}
+					for _, f := range []struct {
+						flag uint32
+						v    *uint32
+					}{{0x100, &duration}, {0x200, &size}, {0x400, &sampleFlags}} {
+						if flags&f.flag != 0 {
+							v, err := next()
+							if err != nil {
+								return err
+							}
+							*f.v = v
+						}
+					}
+					if flags&0x800 != 0 {
+						v, err := next()
+						if err != nil {
+							return err
+						}
+						cts = int32(v)
+						if version == 0 && v > 0x7FFFFFFF {
+							cts = 0
+						}
+					}
+					if cursor < 0 || cursor+int(size) > len(mdat) {
+						return errors.New("fmp4 sample out of mdat")
+					}
+					data := mdat[cursor : cursor+int(size)]
+					cursor += int(size)
+					// 64 位 baseMediaDecodeTime 换算为毫秒(先除后乘避免溢出)，
+					// flv 时间戳按 32 位回绕，接收端按差值计算
+					dts := uint32(base/uint64(tr.timescale)*1000 + base%uint64(tr.timescale)*1000/uint64(tr.timescale))
+					ctsMs := int32(int64(cts) * 1000 / int64(tr.timescale))
+					if t, payload := tr.sampleTag(data, sampleFlags&0x00010000 == 0, ctsMs); payload != nil {
+						d.onTag(t, dts, payload)
+					}
+					base += uint64(duration)
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// 解码配置转换为 flv 序列头
+func (tr *fmp4DemuxTrack) sequenceTag() (byte, []byte) {
+	switch tr.codec {
+	case fourCCAVC1, fourCCAVC3:
+		return codec.FLV_TAG_TYPE_VIDEO, append([]byte{0x10 | flvVideoH264, 0, 0, 0, 0}, tr.config...)
+	case fourCCHEVC, fourCCHEV1:
+		return codec.FLV_TAG_TYPE_VIDEO, append([]byte{0x10 | legacyVideoH265, 0, 0, 0, 0}, tr.config...)
+	case fourCCAV1:
+		return codec.FLV_TAG_TYPE_VIDEO, append([]byte{0x80 | 0x10 | videoPacketSequenceStart, 'a', 'v', '0', '1'}, tr.config...)
+	case fourCCMP4A:
+		return codec.FLV_TAG_TYPE_AUDIO, append([]byte{flvAudioAAC<<4 | 0x0F, 0}, tr.config...)
+	}
+	return 0, nil
+}
+
+// sample 转换为 flv tag 数据
+func (tr *fmp4DemuxTrack) sampleTag(data []byte, key bool, cts int32) (byte, []byte) {
+	frameType := byte(0x20)
+	if key {
+		frameType = 0x10
+	}
+	ctsBytes := []byte{byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	switch tr.codec {
+	case fourCCAVC1, fourCCAVC3:
+		return codec.FLV_TAG_TYPE_VIDEO, append(append([]byte{frameType | flvVideoH264, 1}, ctsBytes...), data...)
+	case fourCCHEVC, fourCCHEV1:
+		return codec.FLV_TAG_TYPE_VIDEO, append(append([]byte{frameType | legacyVideoH265, 1}, ctsBytes...), data...)
+	case fourCCAV1:
+		return codec.FLV_TAG_TYPE_VIDEO, append([]byte{0x80 | frameType | videoPacketCodedFrames, 'a', 'v', '0', '1'}, data...)
+	case fourCCMP4A:
+		return codec.FLV_TAG_TYPE_AUDIO, append([]byte{flvAudioAAC<<4 | 0x0F, 1}, data...)
+	case fourCCOpus:
+		return codec.FLV_TAG_TYPE_AUDIO, append([]byte{audioFormatExHeader<<4 | audioPacketCodedFrames, 'O', 'p', 'u', 's'}, data...)
+	case fourCCALaw:
+		return codec.FLV_TAG_TYPE_AUDIO, append([]byte{flvAudioPCMA<<4 | 0x02}, data...)
+	case fourCCULaw:
+		return codec.FLV_TAG_TYPE_AUDIO, append([]byte{flvAudioPCMU<<4 | 0x02}, data...)
+	}
+	return 0, nil
+}
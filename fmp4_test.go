@@ -0,0 +1,219 @@
+package erwscascade
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+)
+
+type testTag struct {
+	t       byte
+	ts      uint32
+	payload []byte
+}
+
+var (
+	testAVCC = []byte{1, 0x64, 0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x64, 0, 0x1F, 1, 0, 2, 0x68, 0xEE}
+	testASC  = []byte{0x12, 0x10} // AAC LC 44100 双声道
+)
+
+func avcTag(ts uint32, key bool, cts int32, nalu ...byte) testTag {
+	frameType := byte(0x20)
+	if key {
+		frameType = 0x10
+	}
+	p := []byte{frameType | flvVideoH264, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	p = binary.BigEndian.AppendUint32(p, uint32(len(nalu)))
+	return testTag{codec.FLV_TAG_TYPE_VIDEO, ts, append(p, nalu...)}
+}
+
+func aacTag(ts uint32, data ...byte) testTag {
+	return testTag{codec.FLV_TAG_TYPE_AUDIO, ts, append([]byte{flvAudioAAC<<4 | 0x0F, 1}, data...)}
+}
+
+// 测试用的音视频序列: 解码配置、关键帧开始的 GOP 与交错的音频
+func testAVStream() []testTag {
+	return []testTag{
+		{codec.FLV_TAG_TYPE_VIDEO, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...)},
+		{codec.FLV_TAG_TYPE_AUDIO, 0, append([]byte{0xAF, 0}, testASC...)},
+		aacTag(0, 0x21, 0x01),
+		avcTag(0, true, 40, 0x65, 0x88),
+		aacTag(23, 0x21, 0x02),
+		avcTag(40, false, 0, 0x41, 0x9A),
+		aacTag(46, 0x21, 0x03),
+		avcTag(80, false, -40, 0x41, 0x9B),
+		aacTag(69, 0x21, 0x04),
+		avcTag(120, true, 0, 0x65, 0x89),
+	}
+}
+
+func splitTags(tags []testTag) (video, audio []testTag) {
+	for _, tag := range tags {
+		if tag.t == codec.FLV_TAG_TYPE_VIDEO {
+			video = append(video, tag)
+		} else {
+			audio = append(audio, tag)
+		}
+	}
+	return
+}
+
+func equalTags(t *testing.T, name string, got, want []testTag) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d tags, want %d", name, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].t != want[i].t || got[i].ts != want[i].ts || !bytes.Equal(got[i].payload, want[i].payload) {
+			t.Fatalf("%s #%d: got %d %d %x, want %d %d %x", name, i,
+				got[i].t, got[i].ts, got[i].payload, want[i].t, want[i].ts, want[i].payload)
+		}
+	}
+}
+
+func TestFMP4RoundTrip(t *testing.T) {
+	m := &fmp4Muxer{}
+	var stream bytes.Buffer
+	var kinds []itemKind
+	for _, tag := range testAVStream() {
+		segments, kind := m.writeTag(tag.t, tag.ts, tag.payload, true, true)
+		for _, s := range segments {
+			stream.Write(s)
+		}
+		if segments != nil {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	var got []testTag
+	d := newFMP4Demuxer(func(t byte, ts uint32, payload []byte) {
+		got = append(got, testTag{t, ts, append([]byte{}, payload...)})
+	})
+	if err := d.read(&stream); err != io.EOF {
+		t.Fatalf("read() error = %v", err)
+	}
+
+	// 每个轨道最后一帧等待下一帧计算时长，尚未输出
+	gotVideo, gotAudio := splitTags(got)
+	equalTags(t, "video", gotVideo, []testTag{
+		{codec.FLV_TAG_TYPE_VIDEO, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...)},
+		avcTag(0, true, 40, 0x65, 0x88),
+		avcTag(40, false, 0, 0x41, 0x9A),
+		avcTag(80, false, -40, 0x41, 0x9B),
+	})
+	equalTags(t, "audio", gotAudio, []testTag{
+		{codec.FLV_TAG_TYPE_AUDIO, 0, append([]byte{0xAF, 0}, testASC...)},
+		aacTag(0, 0x21, 0x01),
+		aacTag(23, 0x21, 0x02),
+		aacTag(46, 0x21, 0x03),
+	})
+
+	wantKinds := []itemKind{itemConfig, itemAudio, itemKeyframe, itemAudio, itemVideo, itemAudio, itemVideo}
+	if len(kinds) != len(wantKinds) {
+		t.Fatalf("kinds = %v, want %v", kinds, wantKinds)
+	}
+	for i := range wantKinds {
+		if kinds[i] != wantKinds[i] {
+			t.Fatalf("kinds = %v, want %v", kinds, wantKinds)
+		}
+	}
+}
+
+// flv 32 位时间戳回绕后 tfdt 继续递增，解封装后的时间戳差值不变
+func TestFMP4TimestampWrap(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   []uint32
+		want []uint64
+	}{
+		{"monotonic", []uint32{0, 40, 80}, []uint64{0, 40, 80}},
+		{"wrap", []uint32{0xFFFFFFB0, 0xFFFFFFD8, 0, 40}, []uint64{0xFFFFFFB0, 0xFFFFFFD8, 1 << 32, 1<<32 + 40}},
+		{"late frame before wrap", []uint32{0xFFFFFFD8, 0x10, 0xFFFFFFE0, 0x20}, []uint64{0xFFFFFFD8, 1<<32 + 0x10, 0xFFFFFFE0, 1<<32 + 0x20}},
+		{"small backwards", []uint32{100, 90, 120}, []uint64{100, 90, 120}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &fmp4Muxer{}
+			for i, ts := range tt.ts {
+				if got := m.extendTs(ts); got != tt.want[i] {
+					t.Fatalf("extendTs(%#x) #%d = %#x, want %#x", ts, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	m := &fmp4Muxer{}
+	var stream bytes.Buffer
+	tags := []testTag{
+		{codec.FLV_TAG_TYPE_VIDEO, 0xFFFFFFB0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...)},
+		avcTag(0xFFFFFFB0, true, 0, 0x65),
+		avcTag(0xFFFFFFD8, false, 0, 0x41),
+		avcTag(0, false, 0, 0x41),
+		avcTag(40, false, 0, 0x41),
+	}
+	for _, tag := range tags {
+		segments, _ := m.writeTag(tag.t, tag.ts, tag.payload, true, false)
+		for _, s := range segments {
+			stream.Write(s)
+		}
+	}
+	var got []uint32
+	d := newFMP4Demuxer(func(t byte, ts uint32, payload []byte) {
+		if payload[1] == 1 {
+			got = append(got, ts)
+		}
+	})
+	d.read(&stream)
+	want := []uint32{0xFFFFFFB0, 0xFFFFFFD8, 0}
+	if len(got) != len(want) {
+		t.Fatalf("demuxed timestamps = %x, want %x", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("demuxed timestamps = %x, want %x", got, want)
+		}
+	}
+}
+
+// 第三方推流端的 90kHz 时间刻度与超过 uint64 毫秒换算范围的 baseMediaDecodeTime
+func TestFMP4DemuxLargeDecodeTime(t *testing.T) {
+	const timescale = 90000
+	tests := []struct {
+		name    string
+		seconds uint64
+	}{
+		{"zero", 0},
+		{"one second", 1},
+		{"past uint32 ms", 1<<32/1000 + 10},
+		{"base*1000 overflows uint64", 300000000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := []byte{0x65, 0x88}
+			moof := func(dataOffset uint32) []byte {
+				tfhd := mp4FullBox("tfhd", 0, 0x020000, u32(1))
+				tfdt := mp4FullBox("tfdt", 1, 0, binary.BigEndian.AppendUint64(nil, tt.seconds*timescale))
+				trun := mp4FullBox("trun", 0, 0x000301, u32(1), u32(dataOffset), u32(3600), u32(uint32(len(data))))
+				return mp4Box("moof", mp4FullBox("mfhd", 0, 0, u32(1)), mp4Box("traf", tfhd, tfdt, trun))
+			}
+			head := moof(0)
+			head = moof(uint32(len(head) + 8))
+			segment := append(head, mp4Box("mdat", data)...)
+
+			var got []uint32
+			d := newFMP4Demuxer(func(t byte, ts uint32, payload []byte) {
+				got = append(got, ts)
+			})
+			d.tracks[1] = &fmp4DemuxTrack{id: 1, handler: "vide", codec: fourCCAVC1, timescale: timescale}
+			d.read(bytes.NewReader(segment))
+			// 毫秒时间戳按 32 位回绕
+			want := uint32(tt.seconds * 1000)
+			if len(got) != 1 || got[0] != want {
+				t.Fatalf("demuxed timestamp = %v, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package erwscascade
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+/**
+	控制链路心跳: 上下级平台都会定时发送 Ping, 对端回复 Pong(原样带回发送时间)用于计算 RTT
+	任意消息都会刷新最后活跃时间, 超过 interval*maxmiss 未收到任何消息则主动断开链接
+	旧版本插件不收发心跳, 对端发送过 Ping 或 Pong 后才按超时断开, 之前只记录最后活跃时间与 RTT
+**/
+
+type HeartbeatConfig struct {
+	Interval time.Duration `default:"10s" desc:"心跳间隔" yaml:"interval"`
+	MaxMiss  int           `default:"3" desc:"连续丢失多少次心跳判定链接断开" yaml:"maxmiss"`
+}
+
+// 超过该时间未收到任何消息判定链接断开
+func (h HeartbeatConfig) Timeout() time.Duration {
+	maxMiss := h.MaxMiss
+	if maxMiss <= 0 {
+		maxMiss = 3
+	}
+	return h.Interval * time.Duration(maxMiss)
+}
+
+// Ping/Pong 的 Pad
+type HeartbeatMessage struct {
+	Time int64 `json:"time"` // Ping 发送时间 unix 纳秒
+}
+
+// 链路活跃状态，RTT 与最后活跃时间
+type linkStats struct {
+	lastSeen  int64 // unix 纳秒
+	rtt       int64 // 纳秒
+	heartbeat int32 // 对端发送过 Ping 或 Pong，支持心跳
+}
+
+func (s *linkStats) touch() {
+	atomic.StoreInt64(&s.lastSeen, time.Now().UnixNano())
+}
+
+// 新链接，对端可能是不同版本，重新确认是否支持心跳
+func (s *linkStats) reset() {
+	atomic.StoreInt32(&s.heartbeat, 0)
+	s.touch()
+}
+
+// 收到 Ping
+func (s *linkStats) onPing() {
+	atomic.StoreInt32(&s.heartbeat, 1)
+}
+
+func (s *linkStats) LastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastSeen))
+}
+
+func (s *linkStats) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// 收到 Pong 更新 RTT
+func (s *linkStats) onPong(pad []byte) {
+	atomic.StoreInt32(&s.heartbeat, 1)
+	var hb HeartbeatMessage
+	if err := json.Unmarshal(pad, &hb); err != nil || hb.Time == 0 {
+		return
+	}
+	atomic.StoreInt64(&s.rtt, time.Now().UnixNano()-hb.Time)
+}
+
+// 是否超时未收到任何消息，对端不支持心跳时不判定超时
+func (s *linkStats) expired(timeout time.Duration) bool {
+	if atomic.LoadInt32(&s.heartbeat) == 0 {
+		return false
+	}
+	return time.Since(s.LastSeen()) > timeout
+}
+
+func newPingMessage() []byte {
+	pad, _ := json.Marshal(HeartbeatMessage{Time: time.Now().UnixNano()})
+	msg, _ := json.Marshal(CascadingWsMessage{
+		Sn:   nextSn(),
+		Type: Ping,
+		Pad:  pad,
+	})
+	return msg
+}
+
+// 原样带回 Ping 的 Pad
+func newPongMessage(ping CascadingWsMessage) []byte {
+	msg, _ := json.Marshal(CascadingWsMessage{
+		Sn:   ping.Sn,
+		Type: Pong,
+		Pad:  ping.Pad,
+	})
+	return msg
+}
+
+// 下级平台心跳，链接断开或更换后退出
+func (c *CascadingWsClient) keepAlive(conn net.Conn) {
+	if c.Heartbeat.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.Heartbeat.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.IsClosed || c.Conn != conn {
+			return
+		}
+		if c.expired(c.Heartbeat.Timeout()) {
+			log.Printf("server heartbeat timeout, last seen:%v, close connect", c.LastSeen())
+			c.Close()
+			return
+		}
+		if err := c.writeMessage(ws.OpText, newPingMessage()); err != nil {
+			log.Printf("send ping: %v", err)
+		}
+	}
+}
+
+// 上级平台心跳，下级平台断开后退出
+func (p *ErWsCascadeConfig) keepAlive(client *WsClientConn, cid string) {
+	if p.Heartbeat.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.Heartbeat.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+			if client.expired(p.Heartbeat.Timeout()) {
+				log.Printf("client heartbeat timeout cid:%s, last seen:%v, close connect\n", cid, client.LastSeen())
+				(*client.Conn).Close()
+				return
+			}
+			if err := client.writeMessage(ws.OpText, newPingMessage()); err != nil {
+				log.Printf("send ping cid:%s err:%v\n", cid, err)
+			}
+		}
+	}
+}
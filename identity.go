@@ -0,0 +1,68 @@
+package erwscascade
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"m7s.live/engine/v4/util"
+)
+
+// 本机持久化状态，未配置 cid 时自动生成的 cid 保存在这里，重启后保持不变
+type LocalState struct {
+	Cid string `json:"cid"`
+}
+
+func loadLocalState(file string) (state LocalState, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	return
+}
+
+func saveLocalState(file string, state LocalState) error {
+	data, _ := json.MarshalIndent(state, "", "  ")
+	if dir := filepath.Dir(file); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// 先写临时文件再重命名，避免写入中断导致文件损坏
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// 确定本机 cid: 优先使用配置，其次使用状态文件中保存的 cid，都没有则生成并保存
+// 结果写回 CInfo.Cid，注册链路与 ws 推流使用同一个 cid
+func (p *ErWsCascadeConfig) ensureCid() error {
+	if p.CInfo.Cid != "" {
+		return nil
+	}
+	state, err := loadLocalState(p.StateFile)
+	if err == nil && state.Cid != "" {
+		p.CInfo.Cid = state.Cid
+		return nil
+	}
+	newUUID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	state.Cid = newUUID.String()
+	if err = saveLocalState(p.StateFile, state); err != nil {
+		ErWsCascadePlugin.Warn("save local state faild, cid will change after restart")
+	}
+	p.CInfo.Cid = state.Cid
+	return nil
+}
+
+// 本机身份信息
+func (p *ErWsCascadeConfig) API_identity(w http.ResponseWriter, r *http.Request) {
+	util.ReturnValue(p.CInfo, w, r)
+}
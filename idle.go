@@ -0,0 +1,94 @@
+package erwscascade
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	级联流空闲回收: 上级平台的 WssRecever 统计订阅者数量, 无人观看超过 idletimeout 后
+	通过 ws 关闭帧(状态码 StatusIdleStop)通知下级平台, 下级平台结束 WscPusher 且不再重连
+**/
+
+// 上级平台因无人观看要求停止推流的 ws 关闭状态码
+const StatusIdleStop ws.StatusCode = 4001
+
+// 空闲检查间隔
+const idleCheckInterval = 5 * time.Second
+
+// 推流地址参数 idletimeout 只能缩短插件配置的回收时间，插件未配置时可单独开启
+func limitIdleTimeout(server time.Duration, value string) time.Duration {
+	if value == "" {
+		return server
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 || (server > 0 && d > server) {
+		return server
+	}
+	return d
+}
+
+// 发布成功、订阅者加入与离开时引擎在流的协程中通知发布者，在此读取订阅者数量
+func (recever *WssRecever) OnEvent(event any) {
+	switch event.(type) {
+	case IPublisher, *util.Promise[ISubscriber], ISubscriber:
+		if recever.Stream != nil {
+			atomic.StoreInt32(&recever.subscribers, int32(recever.Stream.Subscribers.Len()))
+		}
+	}
+	recever.Publisher.OnEvent(event)
+}
+
+// 上级平台: 无订阅者超过 idle 后通知下级平台停止推流
+func (recever *WssRecever) watchIdle(idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for range ticker.C {
+		if recever.Status != 1 {
+			return
+		}
+		if atomic.LoadInt32(&recever.subscribers) > 0 {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= idle {
+			recever.Info("no subscriber, stop cascade push", zap.Duration("idle", idle))
+			recever.sendStop(StatusIdleStop, "idle")
+			recever.OnConnErr(zap.Error(errors.New("idle timeout")))
+			return
+		}
+	}
+}
+
+// 发送 ws 关闭帧
+func (recever *WssRecever) sendStop(code ws.StatusCode, reason string) {
+	recever.writeLock.Lock()
+	defer recever.writeLock.Unlock()
+	frame := ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason))
+	if err := ws.WriteFrame(*recever.Conn, frame); err != nil {
+		recever.Error("send stop", zap.Error(err))
+	}
+}
+
+// 下级平台: 是否为上级平台要求停止推流(空闲回收、流已被占用、被顶替)
+func isStopNotice(err error) (wsutil.ClosedError, bool) {
+	var closed wsutil.ClosedError
+	if errors.As(err, &closed) {
+		switch closed.Code {
+		case StatusIdleStop, StatusPushRejected, StatusPushTakenOver:
+			return closed, true
+		}
+	}
+	return closed, false
+}
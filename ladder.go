@@ -0,0 +1,245 @@
+package erwscascade
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+)
+
+/**
+	主子码流自适应: 推流地址参数 ladder 声明本地流的码率阶梯(从高到低, 逗号分隔), 如 cam1/main 推流地址加 ?ladder=cam1/sub
+	WscPusher 同时订阅阶梯中的全部本地流, 按发送队列积压与丢帧切换发送的码流, 切换在目标码流的关键帧处进行,
+	切换时重发目标码流的解码配置并平移时间戳, 上级平台看到的是同一路连续的流
+**/
+
+const (
+	ladderCheckInterval = 5 * time.Second
+	ladderUpHold        = 60 * time.Second // 无拥塞持续该时间后尝试升档
+	ladderMaxUpHold     = 10 * time.Minute // 升档失败后等待时间加倍的上限
+)
+
+type ladderLevel struct {
+	streamPath string
+	sub        *LadderSubscriber // 第 0 档为 WscPusher 自身
+	videoSeq   []byte            // 最近的解码配置 tag
+	audioSeq   []byte
+}
+
+type ladder struct {
+	sync.Mutex
+	levels []*ladderLevel
+	active int // 正在发送的档位
+	target int // 等待关键帧切换的档位，-1 无
+
+	offset  int64  // 时间戳平移
+	lastOut uint32 // 最近发送的时间戳
+
+	upHold     time.Duration
+	stableFrom time.Time
+	lastUp     time.Time
+	closed     bool
+}
+
+// 下级平台: 订阅码率阶梯中其他档位的本地流
+type LadderSubscriber struct {
+	Subscriber
+	pusher *WscPusher
+	level  int
+}
+
+func (sub *LadderSubscriber) OnEvent(event any) {
+	switch v := event.(type) {
+	case FLVFrame:
+		sub.pusher.writeLadderTag(sub.level, v)
+	default:
+		sub.Subscriber.OnEvent(event)
+	}
+}
+
+// 推流地址中的码率阶梯，第 0 档为推送的流
+func parseLadder(streamPath string, value string) (paths []string) {
+	if value == "" {
+		return nil
+	}
+	paths = append(paths, streamPath)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.Trim(strings.TrimSpace(v), "/"); v != "" && v != streamPath {
+			paths = append(paths, v)
+		}
+	}
+	if len(paths) < 2 {
+		return nil
+	}
+	return
+}
+
+// 下级平台: 订阅阶梯中的其他档位并开始自适应切换
+func (pusher *WscPusher) startLadder(paths []string) {
+	l := &ladder{target: -1, upHold: ladderUpHold, stableFrom: time.Now()}
+	l.levels = append(l.levels, &ladderLevel{streamPath: paths[0]})
+	pusher.ladder = l
+	for _, path := range paths[1:] {
+		level := &ladderLevel{streamPath: path}
+		sub := &LadderSubscriber{pusher: pusher, level: len(l.levels)}
+		configCopy := pusher.Cc.GetSubscribeConfig()
+		sub.Config = &configCopy
+		if err := ErWsCascadePlugin.Subscribe(path, sub); err != nil {
+			pusher.Error("ladder subscribe", zap.String("streamPath", path), zap.Error(err))
+			continue
+		}
+		level.sub = sub
+		l.Lock()
+		l.levels = append(l.levels, level)
+		l.Unlock()
+		go sub.PlayFLV()
+	}
+	pusher.Info("ladder start", zap.Strings("levels", paths))
+	go pusher.watchLadder(l)
+}
+
+// 下级平台: 结束其他档位的订阅
+func (pusher *WscPusher) stopLadder() {
+	l := pusher.ladder
+	if l == nil {
+		return
+	}
+	pusher.ladder = nil
+	l.Lock()
+	l.closed = true
+	l.Unlock()
+	for _, level := range l.levels {
+		if level.sub != nil {
+			level.sub.Stop(zap.String("reason", "cascade push end"))
+		}
+	}
+}
+
+// 收到某一档位的 flv tag，只发送当前档位，切换档位在目标档位关键帧处进行；
+// 只有发送队列入队在锁内，网络写在发送协程
+func (pusher *WscPusher) writeLadderTag(idx int, tag FLVFrame) {
+	l := pusher.ladder
+	if l == nil || pusher.Status == 0 {
+		return
+	}
+	var data []byte
+	for _, buf := range net.Buffers(tag) {
+		data = append(data, buf...)
+	}
+	t, timestamp, payload, err := pusher.ParseFLVTag(data)
+	if err != nil {
+		return
+	}
+
+	l.Lock()
+	if l.closed || idx >= len(l.levels) {
+		l.Unlock()
+		return
+	}
+	level := l.levels[idx]
+	if isSequenceTag(t, payload) {
+		if t == codec.FLV_TAG_TYPE_VIDEO {
+			level.videoSeq = data
+		} else {
+			level.audioSeq = data
+		}
+	}
+	var out [][]byte
+	switch {
+	case idx == l.active:
+		out = [][]byte{data}
+	case idx == l.target && t == codec.FLV_TAG_TYPE_VIDEO && !isSequenceTag(t, payload) && (payload[0]>>4)&0x07 == 1:
+		// 目标档位关键帧，切换并重发解码配置
+		pusher.Info("ladder switch", zap.String("from", l.levels[l.active].streamPath), zap.String("to", level.streamPath))
+		l.active, l.target = idx, -1
+		l.offset = int64(l.lastOut) + 1 - int64(timestamp)
+		for _, seq := range [][]byte{level.videoSeq, level.audioSeq} {
+			if seq != nil {
+				out = append(out, append([]byte{}, seq...))
+			}
+		}
+		out = append(out, data)
+	}
+	// 解码配置使用关键帧的时间戳；各档位在各自的协程回调，
+	// 封装与入队在锁内进行，保证封装器单协程使用且发送顺序与切换顺序一致
+	for _, d := range out {
+		l.rebase(d, timestamp)
+		pusher.writeTag(d)
+	}
+	l.Unlock()
+}
+
+// 平移时间戳，保证切换后时间戳连续
+func (l *ladder) rebase(data []byte, timestamp uint32) uint32 {
+	ts := uint32(int64(timestamp) + l.offset)
+	setFLVTagTimestamp(data, ts)
+	if ts > l.lastOut {
+		l.lastOut = ts
+	}
+	return ts
+}
+
+func setFLVTagTimestamp(data []byte, ts uint32) {
+	data[4], data[5], data[6], data[7] = byte(ts>>16), byte(ts>>8), byte(ts), byte(ts>>24)
+}
+
+// 按发送队列积压与丢帧决定档位: 拥塞时降档，持续无拥塞时尝试升档，升档后很快拥塞则加倍等待时间
+func (pusher *WscPusher) watchLadder(l *ladder) {
+	ticker := time.NewTicker(ladderCheckInterval)
+	defer ticker.Stop()
+	stats := pusher.stats
+	lastDropped := atomic.LoadUint64(&stats.droppedVideo)
+	for range ticker.C {
+		l.Lock()
+		if l.closed {
+			l.Unlock()
+			return
+		}
+		dropped := atomic.LoadUint64(&stats.droppedVideo)
+		depth := int(atomic.LoadInt32(&stats.depth))
+		congested := dropped > lastDropped || (pusher.Cc.SendQueue > 0 && depth > pusher.Cc.SendQueue/2)
+		lastDropped = dropped
+		now := time.Now()
+		current := l.active
+		if l.target >= 0 {
+			current = l.target
+		}
+		switch {
+		case congested:
+			l.stableFrom = now
+			if current+1 < len(l.levels) {
+				if now.Sub(l.lastUp) < 2*ladderCheckInterval {
+					// 升档失败
+					l.upHold *= 2
+					if l.upHold > ladderMaxUpHold {
+						l.upHold = ladderMaxUpHold
+					}
+				}
+				l.target = current + 1
+				pusher.Info("ladder down", zap.String("to", l.levels[l.target].streamPath), zap.Int("queueDepth", depth))
+			}
+		case current > 0 && now.Sub(l.stableFrom) >= l.upHold:
+			l.target = current - 1
+			l.stableFrom, l.lastUp = now, now
+			pusher.Info("ladder up", zap.String("to", l.levels[l.target].streamPath), zap.Duration("hold", l.upHold))
+		case current == 0 && now.Sub(l.lastUp) > ladderMaxUpHold:
+			l.upHold = ladderUpHold
+		}
+		if l.target == l.active {
+			l.target = -1
+		}
+		l.Unlock()
+	}
+}
+
+// 当前档位
+func (l *ladder) current() (int, string) {
+	l.Lock()
+	defer l.Unlock()
+	return l.active, l.levels[l.active].streamPath
+}
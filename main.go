@@ -2,12 +2,17 @@ package erwscascade
 
 import (
 	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
@@ -25,6 +30,13 @@ type ServerConfig struct {
 	Host       string `default:"127.0.0.1" desc:"上级平台IP" yaml:"host"`
 	Port       int    `default:"8440" desc:"上级平台端口" yaml:"port"`
 	ConextPath string `default:"" desc:"上级平台根目录" yaml:"conextpath"`
+	Secret     string `default:"" desc:"注册鉴权密钥,与上级平台auth中本机cid的密钥一致" yaml:"secret"`
+
+	Insecure    bool   `default:"false" desc:"wss时跳过证书校验" yaml:"insecure"`
+	CAFile      string `default:"" desc:"wss时校验上级平台证书的CA文件" yaml:"cafile"`
+	Fingerprint string `default:"" desc:"上级平台证书sha256指纹,配置后只校验指纹" yaml:"fingerprint"`
+	CertFile    string `default:"" desc:"双向认证客户端证书" yaml:"certfile"`
+	KeyFile     string `default:"" desc:"双向认证客户端私钥" yaml:"keyfile"`
 }
 
 type ClientInfo struct {
@@ -33,11 +45,46 @@ type ClientInfo struct {
 	Serial string `default:"" desc:"上级平台端口" yaml:"serial" json:"serial"`
 }
 
+// 下级平台执行代理请求时访问的本机 api
+type LocalConfig struct {
+	Origin             string `default:"" desc:"本机api地址,如https://127.0.0.1:8441/m7s,为空则按引擎http监听配置生成" yaml:"origin"`
+	InsecureSkipVerify bool   `default:"false" desc:"https时是否跳过证书校验,回环地址未配置cafile时总是跳过" yaml:"insecureskipverify"`
+	CAFile             string `default:"" desc:"https时校验本机证书的CA文件" yaml:"cafile"`
+}
+
 type ErWsCascadeConfig struct {
 	DefaultYaml
 	CInfo ClientInfo `desc:"客户端信息"  yaml:"cinfo"`
+	//cinfo.cid 为空时自动生成的 cid 保存在该文件
+	StateFile string      `default:"erwscascade_state.json" desc:"本机状态文件" yaml:"statefile"`
+	Local     LocalConfig `desc:"本机api配置" yaml:"local"`
+	//控制链路心跳，上下级平台均生效
+	Heartbeat HeartbeatConfig `desc:"心跳配置" yaml:"heartbeat"`
+	//上级平台注册链路及 ws 推流的重连退避
+	Backoff BackoffConfig `desc:"重连退避配置" yaml:"backoff"`
 	//erwscascade/wsocket/register
 	ServerConfig []ServerConfig `yaml:"server"`
+	//上级平台: 下级平台注册鉴权 cid -> 密钥，为空则不鉴权
+	Auth map[string]string `desc:"下级平台注册鉴权密钥" yaml:"auth"`
+	//上级平台: 校验下级平台客户端证书的CA，证书 CN(或 certcid 映射) 须与 cid 一致
+	ClientCA string            `desc:"下级平台客户端证书CA" yaml:"clientca"`
+	CertCid  map[string]string `desc:"客户端证书CN到cid的映射" yaml:"certcid"`
+	//上级平台: 配置 clientca 时接收注册与推流的双向认证监听
+	MTLS MTLSConfig `desc:"双向认证监听" yaml:"mtls"`
+	//上级平台: 订阅不存在的 streamPath-cid 时请求下级平台推流
+	PushOnSub bool `default:"true" desc:"按需级联" yaml:"pushonsub"`
+	//上级平台: 接收级联流的命名模板，变量 {cid} {name} {serial} {streamPath} {app} {stream}
+	StreamName string `default:"{streamPath}-{cid}" desc:"级联流命名模板" yaml:"streamname"`
+	//上级平台: 允许推流地址参数 streamname 覆盖命名模板，参数须包含 {cid}
+	StreamNameQuery bool `default:"false" desc:"允许推流指定命名模板" yaml:"streamnamequery"`
+	//上级平台: 级联流无订阅者超过该时间通知下级平台停止推流，0 不回收，推流地址参数 idletimeout 可单独指定更短的时间
+	IdleTimeout time.Duration `default:"0s" desc:"级联流空闲回收时间" yaml:"idletimeout"`
+	//下级平台: ws 推流握手时协商 Enhanced FLV(HEVC/AV1/Opus)，上级平台不支持时回退为传统 FLV
+	EnhancedFlv bool `default:"true" desc:"推流使用Enhanced FLV" yaml:"enhancedflv"`
+	//下级平台: ws 推流发送队列长度(帧)，队列满时丢弃非关键帧视频，0 为同步发送
+	SendQueue int `default:"256" desc:"推流发送队列长度" yaml:"sendqueue"`
+	//上级平台: 不同下级平台推送到同一个流时的冲突策略 reject、keepfirst、takeover，推流地址参数 collision 可单独指定
+	Collision string `default:"reject" desc:"级联流冲突策略" yaml:"collision"`
 	config.Publish
 	config.Subscribe
 	config.Push
@@ -50,16 +97,30 @@ func (p *ErWsCascadeConfig) push(streamPath string, url string) {
 }
 
 func (p *ErWsCascadeConfig) OnEvent(event any) {
-	switch event.(type) {
+	switch v := event.(type) {
 	case FirstConfig:
+		p.checkStreamName()
+		p.setupClientCA()
 		p.onClientSetup()
 		for streamPath, url := range p.PushList {
 			p.push(streamPath, url)
 		}
 		break
+	case InvitePublish: //按需级联
+		if p.PushOnSub {
+			go p.invitePush(v.Target)
+		}
+		break
 	case config.Config:
 		break
+	case SEpublish:
+		endInvite(v.Target.Path)
+		p.notifyCatalog(CatalogPublish, v.Target.Path)
+		break
 	case SEclose:
+		p.notifyCatalog(CatalogUnpublish, v.Target.Path)
+		removeReceivedStream(v.Target.Path)
+		endInvite(v.Target.Path)
 		break
 	}
 }
@@ -159,14 +220,11 @@ func (p *ErWsCascadeConfig) HttpProxy_(w http.ResponseWriter, r *http.Request) {
 		}
 		req.Body = body
 	}
-	//ws send msg
-	rsp, err := p.transWsProxyMessage(cid, req)
-	if err != nil {
+	//ws send msg，支持分块回传(http-flv、sse、文件下载等)
+	if err := p.streamWsProxyMessage(w, r, cid, req); err != nil {
 		ErWsCascadePlugin.Error("WsProxy faild", zap.Error(err))
-		return
+		http.Error(w, err.Error(), http.StatusBadGateway)
 	}
-	// 将读取的 Body 内容作为响应返回给客户端
-	w.Write(rsp)
 
 	return
 
@@ -208,6 +266,76 @@ func (p *ErWsCascadeConfig) HttpProxy_(w http.ResponseWriter, r *http.Request) {
 	// }
 }
 
+// 逐跳请求头，不转发给下级平台
+var hopReqHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Te",
+	"Trailer",
+}
+
+// 上级平台的会话凭据，不泄露给下级平台
+var credentialReqHeaders = []string{
+	"Cookie",
+	"Authorization",
+}
+
+/*
+路径方式的代理接口，请求方法、路径、原始查询参数、请求头与内容原样转发给下级平台
+
+/erwscascade/proxy/{cid}/{path...}
+
+示例: 浏览器请求 /erwscascade/proxy/test-c001/webrtc/play/njtv/glgc 等价于在下级平台 test-c001 上请求 /webrtc/play/njtv/glgc
+*/
+func (p *ErWsCascadeConfig) Proxy_(w http.ResponseWriter, r *http.Request) {
+	// 使用未解码的路径，保留 %2F 等编码字符
+	escapedPath := r.URL.EscapedPath()
+	idx := strings.Index(escapedPath, "/proxy/")
+	if idx < 0 {
+		util.ReturnError(util.APIErrorQueryParse, "invalid proxy path", w, r)
+		return
+	}
+	rest := escapedPath[idx+len("/proxy/"):]
+	escapedCid, targetPath, _ := strings.Cut(rest, "/")
+	cid, err := url.PathUnescape(escapedCid)
+	if err != nil || cid == "" {
+		util.ReturnError(util.APIErrorQueryParse, "invalid cid", w, r)
+		return
+	}
+	targetURL := "/" + targetPath
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	req := ProxyMessage{
+		Url:    targetURL,
+		Method: r.Method,
+		Header: r.Header.Clone(),
+	}
+	for _, key := range hopReqHeaders {
+		req.Header.Del(key)
+	}
+	for _, key := range credentialReqHeaders {
+		req.Header.Del(key)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		ErWsCascadePlugin.Error("Error reading request body", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Body = body
+
+	if err := p.streamWsProxyMessage(w, r, cid, req); err != nil {
+		ErWsCascadePlugin.Error("WsProxy faild", zap.String("cid", cid), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
 /*
 	func (p *ErWsCascadeConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/erwscascade/" {
@@ -262,6 +390,22 @@ type CascadingStream struct {
 	StreamPath string
 }
 
+// 配置文件中拉流的来源，如 rtspPull
+func pullSource(streamPath string) (string, bool) {
+	for name, p := range Plugins {
+		if pullcfg, ok := p.Config.(config.PullConfig); ok {
+			conf := pullcfg.GetPullConfig()
+			if _, ok := conf.PullOnStart[streamPath]; ok {
+				return name + "Pull", true
+			}
+			if _, ok := conf.PullOnSub[streamPath]; ok {
+				return name + "Pull", true
+			}
+		}
+	}
+	return "", false
+}
+
 func filterStreams() (ss []*CascadingStream) {
 
 	//优先获取配置文件中视频流
@@ -315,15 +459,28 @@ func filterStreams() (ss []*CascadingStream) {
 	return
 }
 
+// 客户端列表项，附带链路状态
+type ClientStatus struct {
+	ClientInfo
+	LastSeen time.Time `json:"lastSeen"` // 最后收到消息的时间
+	RTT      int64     `json:"rtt"`      // 心跳往返时延 ms
+}
+
 // 客户端列表
 func (*ErWsCascadeConfig) API_clientlist(w http.ResponseWriter, r *http.Request) {
 	// 输出map对象内容
-	list := make([]ClientInfo, 0)
+	list := make([]ClientStatus, 0)
 
+	connectionsLock.RLock()
 	for _, value := range clientConnections {
 		//fmt.Println("Key:", key, "Value:", value)
-		list = append(list, value.CInfo)
+		list = append(list, ClientStatus{
+			ClientInfo: value.CInfo,
+			LastSeen:   value.LastSeen(),
+			RTT:        value.RTT().Milliseconds(),
+		})
 	}
+	connectionsLock.RUnlock()
 	util.ReturnValue(list, w, r)
 }
 
@@ -337,7 +494,13 @@ func (p *ErWsCascadeConfig) API_streamlist(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// 下级平台流列表
+	// 下级平台流列表，优先使用同步的流目录
+	if ss, updatedAt, ok := getClientCatalog(cid); ok {
+		writeClientCatalog(w, r, ss, updatedAt, true)
+		return
+	}
+
+	// 老版本下级平台不同步流目录，实时请求
 	req := ProxyMessage{
 		Url:    "/erwscascade/api/streamlist", //url 解码
 		Method: "GET",
@@ -347,11 +510,138 @@ func (p *ErWsCascadeConfig) API_streamlist(w http.ResponseWriter, r *http.Reques
 	rsp, err := p.transWsProxyMessage(cid, req)
 	if err != nil {
 		ErWsCascadePlugin.Error("WsProxy faild", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	// 将读取的 Body 内容作为响应返回给客户端
-	w.Write(rsp)
+	if rsp.Status == http.StatusOK {
+		if ss, err := decodeStreamList(rsp.Body); err == nil {
+			writeClientCatalog(w, r, ss, time.Now(), false)
+			return
+		}
+	}
+	// 将下级平台的状态码、响应头与内容返回给客户端
+	writeProxyRsp(w, rsp)
 
 	return
 
 }
+
+// 下级平台的流，附带所属平台信息
+type ClientStream struct {
+	Cid  string `json:"cid"`
+	Name string `json:"name"`
+	CascadingStream
+}
+
+type ClientError struct {
+	Cid   string `json:"cid"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// 下级平台流列表的来源与更新时间
+type ClientFreshness struct {
+	Cid       string    `json:"cid"`
+	Name      string    `json:"name"`
+	Cached    bool      `json:"cached"`    // 来自目录缓存，否则为实时请求
+	UpdatedAt time.Time `json:"updatedAt"` // 目录缓存更新时间或请求时间
+}
+
+// 汇总的下级平台流列表，部分下级平台失败时仍返回其余结果
+type CStreamList struct {
+	Streams []*ClientStream    `json:"streams"`
+	Errors  []*ClientError     `json:"errors"`
+	Clients []*ClientFreshness `json:"clients"`
+}
+
+// cstreamlist 单个平台超时时间上限
+const cstreamlistMaxTimeout = 60 * time.Second
+
+// 解析下级平台 streamlist 响应，兼容直接返回数组与 {data:[...]} 两种格式
+func decodeStreamList(body []byte) (ss []*CascadingStream, err error) {
+	if err = json.Unmarshal(body, &ss); err == nil {
+		return
+	}
+	var wrapped struct {
+		Data []*CascadingStream `json:"data"`
+	}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Data, nil
+}
+
+/*
+所有下级平台流列表，并发请求各下级平台
+
+/erwscascade/api/cstreamlist?cid=[可选,只查询该下级平台]&timeout=[可选,单个平台超时时间,默认5s,最大60s]
+*/
+func (p *ErWsCascadeConfig) API_cstreamlist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	timeout := 5 * time.Second
+	if t := query.Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 || d > cstreamlistMaxTimeout {
+			util.ReturnError(util.APIErrorQueryParse, "invalid timeout, should be in (0, 60s]", w, r)
+			return
+		}
+		timeout = d
+	}
+
+	clients := make(map[string]ClientInfo)
+	connectionsLock.RLock()
+	for cid, client := range clientConnections {
+		if c := query.Get("cid"); c == "" || c == cid {
+			clients[cid] = client.CInfo
+		}
+	}
+	connectionsLock.RUnlock()
+
+	result := CStreamList{
+		Streams: make([]*ClientStream, 0),
+		Errors:  make([]*ClientError, 0),
+		Clients: make([]*ClientFreshness, 0),
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for cid, cinfo := range clients {
+		wg.Add(1)
+		go func(cid string, cinfo ClientInfo) {
+			defer wg.Done()
+			ss, updatedAt, cached, err := p.fetchClientStreams(cid, timeout)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				result.Errors = append(result.Errors, &ClientError{Cid: cid, Name: cinfo.Name, Error: err.Error()})
+				return
+			}
+			result.Clients = append(result.Clients, &ClientFreshness{Cid: cid, Name: cinfo.Name, Cached: cached, UpdatedAt: updatedAt})
+			for _, s := range ss {
+				result.Streams = append(result.Streams, &ClientStream{Cid: cid, Name: cinfo.Name, CascadingStream: *s})
+			}
+		}(cid, cinfo)
+	}
+	wg.Wait()
+
+	util.ReturnValue(result, w, r)
+}
+
+// 通过控制链路获取单个下级平台的流列表，优先使用目录缓存，返回更新时间与是否来自缓存
+func (p *ErWsCascadeConfig) fetchClientStreams(cid string, timeout time.Duration) (ss []*CascadingStream, updatedAt time.Time, cached bool, err error) {
+	if cs, t, ok := getClientCatalog(cid); ok {
+		return cs, t, true, nil
+	}
+	req := ProxyMessage{
+		Url:    "/erwscascade/api/streamlist",
+		Method: "GET",
+	}
+	rsp, err := p.transWsProxyMessageTimeout(cid, req, timeout)
+	if err != nil {
+		return nil, updatedAt, false, err
+	}
+	if rsp.Status != http.StatusOK {
+		return nil, updatedAt, false, fmt.Errorf("status %d", rsp.Status)
+	}
+	ss, err = decodeStreamList(rsp.Body)
+	return ss, time.Now(), false, err
+}
@@ -0,0 +1,164 @@
+package erwscascade
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	上级平台接收级联流的命名模板, 可用变量:
+	{cid} {name} {serial}  下级平台信息, 模板须包含 {cid}
+	{streamPath}           下级平台原始流, 如 njtv/glgc
+	{app} {stream}         原始流第一段与其余部分, 如 njtv 与 glgc
+**/
+
+const defaultStreamName = "{streamPath}-{cid}"
+
+// 上级平台: 推流使用的命名模板，推流地址参数 streamname 需插件开启 streamnamequery 且包含 {cid}，
+// 避免下级平台发布到其他下级平台的命名空间
+func (p *ErWsCascadeConfig) streamNameTemplate(cid string, value string) string {
+	if value == "" || value == p.StreamName {
+		return p.StreamName
+	}
+	if !p.StreamNameQuery || !strings.Contains(value, "{cid}") {
+		ErWsCascadePlugin.Warn("wspush streamname ignored", zap.String("cid", cid), zap.String("streamname", value), zap.Bool("streamnamequery", p.StreamNameQuery))
+		return p.StreamName
+	}
+	return value
+}
+
+// 上级平台: 插件命名模板同样须包含 {cid}，{name} {serial} 由下级平台自行上报，不能区分下级平台
+func (p *ErWsCascadeConfig) checkStreamName() {
+	if p.StreamName == "" || strings.Contains(p.StreamName, "{cid}") {
+		return
+	}
+	ErWsCascadePlugin.Error("streamname must contain {cid}, use default", zap.String("streamname", p.StreamName), zap.String("default", defaultStreamName))
+	p.StreamName = defaultStreamName
+}
+
+// 按模板生成上级平台发布的流名称
+func renderStreamName(tpl string, cinfo ClientInfo, streamPath string) string {
+	if tpl == "" {
+		tpl = defaultStreamName
+	}
+	app, stream, _ := strings.Cut(streamPath, "/")
+	return strings.NewReplacer(
+		"{cid}", cinfo.Cid,
+		"{name}", cinfo.Name,
+		"{serial}", cinfo.Serial,
+		"{streamPath}", streamPath,
+		"{app}", app,
+		"{stream}", stream,
+	).Replace(tpl)
+}
+
+// 按模板从上级平台流名称解析下级平台原始流，下级平台信息按字面匹配
+func parseStreamName(tpl string, cinfo ClientInfo, name string) (streamPath string, ok bool) {
+	if tpl == "" {
+		tpl = defaultStreamName
+	}
+	var expr strings.Builder
+	var groups []string
+	expr.WriteString("^")
+	for rest := tpl; rest != ""; {
+		start := strings.Index(rest, "{")
+		end := strings.Index(rest, "}")
+		if start < 0 || end < start {
+			expr.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		expr.WriteString(regexp.QuoteMeta(rest[:start]))
+		switch v := rest[start+1 : end]; v {
+		case "cid":
+			expr.WriteString(regexp.QuoteMeta(cinfo.Cid))
+		case "name":
+			expr.WriteString(regexp.QuoteMeta(cinfo.Name))
+		case "serial":
+			expr.WriteString(regexp.QuoteMeta(cinfo.Serial))
+		case "streamPath", "stream":
+			expr.WriteString("(.+)")
+			groups = append(groups, v)
+		case "app":
+			expr.WriteString("([^/]+)")
+			groups = append(groups, v)
+		default:
+			expr.WriteString(regexp.QuoteMeta(rest[start : end+1]))
+		}
+		rest = rest[end+1:]
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return "", false
+	}
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	vars := make(map[string]string)
+	for i, g := range groups {
+		vars[g] = m[i+1]
+	}
+	if v, found := vars["streamPath"]; found {
+		return v, true
+	}
+	if vars["app"] != "" && vars["stream"] != "" {
+		return vars["app"] + "/" + vars["stream"], true
+	}
+	return "", false
+}
+
+// 上级平台接收的级联流
+type ReceivedStream struct {
+	StreamPath string `json:"streamPath"` // 上级平台发布的流
+	Cid        string `json:"cid"`
+	Name       string `json:"name"`
+	Original   string `json:"original"` // 下级平台原始流
+
+	recever *WssRecever
+}
+
+var receivedStreams = make(map[string]*ReceivedStream)
+var receivedStreamsLock sync.RWMutex
+
+func addReceivedStream(rs *ReceivedStream) {
+	receivedStreamsLock.Lock()
+	receivedStreams[rs.StreamPath] = rs
+	receivedStreamsLock.Unlock()
+}
+
+func removeReceivedStream(streamPath string) {
+	receivedStreamsLock.Lock()
+	delete(receivedStreams, streamPath)
+	receivedStreamsLock.Unlock()
+}
+
+/*
+级联流反查，返回上级平台流对应的下级平台与原始流
+
+/erwscascade/api/lookup?streamPath=[上级平台流,为空返回全部]
+*/
+func (p *ErWsCascadeConfig) API_lookup(w http.ResponseWriter, r *http.Request) {
+	streamPath := r.URL.Query().Get("streamPath")
+	receivedStreamsLock.RLock()
+	defer receivedStreamsLock.RUnlock()
+	if streamPath == "" {
+		list := make([]*ReceivedStream, 0, len(receivedStreams))
+		for _, rs := range receivedStreams {
+			list = append(list, rs)
+		}
+		util.ReturnValue(list, w, r)
+		return
+	}
+	rs, ok := receivedStreams[streamPath]
+	if !ok {
+		util.ReturnError(util.APIErrorNoStream, "no cascade stream "+streamPath, w, r)
+		return
+	}
+	util.ReturnValue(rs, w, r)
+}
@@ -0,0 +1,71 @@
+package erwscascade
+
+import "testing"
+
+func TestStreamNameRoundTrip(t *testing.T) {
+	cinfo := ClientInfo{Cid: "c001", Name: "gl.gc", Serial: "SN-01"}
+	tests := []struct {
+		tpl        string
+		streamPath string
+		want       string
+	}{
+		{"", "njtv/glgc", "njtv/glgc-c001"},
+		{"{streamPath}-{cid}", "njtv/a/b", "njtv/a/b-c001"},
+		{"{cid}/{streamPath}", "njtv/glgc", "c001/njtv/glgc"},
+		{"{app}/{cid}-{stream}", "njtv/glgc", "njtv/c001-glgc"},
+		{"{app}/{cid}-{stream}", "njtv/a/b", "njtv/c001-a/b"},
+		{"cascade/{name}/{serial}/{streamPath}", "live/cam1", "cascade/gl.gc/SN-01/live/cam1"},
+		{"{streamPath}-{unknown}", "live/cam1", "live/cam1-{unknown}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tpl+"|"+tt.streamPath, func(t *testing.T) {
+			got := renderStreamName(tt.tpl, cinfo, tt.streamPath)
+			if got != tt.want {
+				t.Fatalf("renderStreamName() = %q, want %q", got, tt.want)
+			}
+			streamPath, ok := parseStreamName(tt.tpl, cinfo, got)
+			if !ok || streamPath != tt.streamPath {
+				t.Fatalf("parseStreamName(%q) = %q, %v, want %q", got, streamPath, ok, tt.streamPath)
+			}
+		})
+	}
+}
+
+func TestParseStreamNameMismatch(t *testing.T) {
+	cinfo := ClientInfo{Cid: "c001", Name: "gl.gc"}
+	tests := []struct {
+		tpl  string
+		name string
+	}{
+		{"{streamPath}-{cid}", "njtv/glgc-c002"},
+		{"{cid}/{streamPath}", "c001x/njtv/glgc"},
+		{"{name}/{streamPath}", "glxgc/njtv/glgc"}, // 下级平台信息按字面匹配，. 不是通配符
+		{"{app}/{stream}", "glgc"},
+		{"{cid}", "c001"}, // 模板不含原始流
+	}
+	for _, tt := range tests {
+		t.Run(tt.tpl+"|"+tt.name, func(t *testing.T) {
+			if streamPath, ok := parseStreamName(tt.tpl, cinfo, tt.name); ok {
+				t.Fatalf("parseStreamName() = %q, want no match", streamPath)
+			}
+		})
+	}
+}
+
+func TestCheckStreamName(t *testing.T) {
+	tests := []struct {
+		tpl  string
+		want string
+	}{
+		{"", ""},
+		{"{cid}/{app}/{stream}", "{cid}/{app}/{stream}"},
+		{"{name}/{streamPath}", defaultStreamName},
+		{"{serial}-{streamPath}", defaultStreamName},
+	}
+	for _, tt := range tests {
+		p := &ErWsCascadeConfig{StreamName: tt.tpl}
+		if p.checkStreamName(); p.StreamName != tt.want {
+			t.Errorf("checkStreamName(%q) = %q, want %q", tt.tpl, p.StreamName, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package erwscascade
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"go.uber.org/zap"
+)
+
+/**
+	按需级联: 上级平台有订阅者订阅级联流(默认 streamPath-cid, 见 streamname)且流不存在时, 通过控制链路请求下级平台推流,
+	下级平台推送本地 streamPath 到上级平台 wspush 接口, 订阅者等待发布者上线
+**/
+
+// PushReq 的 Pad
+type PushRequest struct {
+	StreamPath string `json:"streamPath"` // 下级平台本地流
+}
+
+// PushRsp 的 Pad
+type PushResult struct {
+	Target string `json:"target"`
+	Error  string `json:"error,omitempty"`
+}
+
+// 等待下级平台应答推流请求的超时时间
+const pushReqTimeout = 10 * time.Second
+
+// 推流请求成功后等待发布的时间，期间同一个流不再重复请求
+const inviteHold = 30 * time.Second
+
+// 正在请求推流的级联流，多个订阅者同时订阅时只请求一次
+var (
+	invitingStreams = make(map[string]time.Time)
+	invitingLock    sync.Mutex
+)
+
+// 登记推流请求，已在请求中返回 false
+func beginInvite(streamPath string) bool {
+	invitingLock.Lock()
+	defer invitingLock.Unlock()
+	if t, ok := invitingStreams[streamPath]; ok && time.Since(t) < inviteHold {
+		return false
+	}
+	invitingStreams[streamPath] = time.Now()
+	return true
+}
+
+// 推流请求失败或流已发布、关闭
+func endInvite(streamPath string) {
+	invitingLock.Lock()
+	delete(invitingStreams, streamPath)
+	invitingLock.Unlock()
+}
+
+// 按命名模板从上级平台的流名称解析下级平台 cid 与原始流，只匹配已注册的下级平台
+func (p *ErWsCascadeConfig) parseCascadeStreamPath(streamPath string) (cid string, original string, ok bool) {
+	connectionsLock.RLock()
+	defer connectionsLock.RUnlock()
+	for c, client := range clientConnections {
+		cinfo := client.CInfo
+		cinfo.Cid = c
+		// 多个 cid 都匹配时取最长的
+		if o, matched := parseStreamName(p.StreamName, cinfo, streamPath); matched && len(c) > len(cid) {
+			cid, original, ok = c, o, true
+		}
+	}
+	return
+}
+
+// 上级平台: 订阅不存在的级联流时请求下级平台推流
+func (p *ErWsCascadeConfig) invitePush(streamPath string) {
+	cid, original, ok := p.parseCascadeStreamPath(streamPath)
+	if !ok || !beginInvite(streamPath) {
+		return
+	}
+	ErWsCascadePlugin.Info("invite push", zap.String("cid", cid), zap.String("streamPath", original))
+	pad, _ := json.Marshal(PushRequest{StreamPath: original})
+	rsp, err := p.requestClient(cid, PushReq, pad, PushRsp, pushReqTimeout)
+	if err != nil {
+		ErWsCascadePlugin.Error("invite push", zap.String("cid", cid), zap.String("streamPath", original), zap.Error(err))
+		endInvite(streamPath)
+		return
+	}
+	var result PushResult
+	json.Unmarshal(rsp.Pad, &result)
+	if result.Error != "" {
+		ErWsCascadePlugin.Error("invite push", zap.String("cid", cid), zap.String("streamPath", original), zap.String("error", result.Error))
+		endInvite(streamPath)
+		return
+	}
+	// 等待发布，超过 inviteHold 未发布时允许再次请求
+	ErWsCascadePlugin.Info("invite push ok", zap.String("cid", cid), zap.String("target", result.Target))
+}
+
+// 下级平台: 收到推流请求，推送本地流到该上级平台
+func (c *CascadingWsClient) onPushReq(wsMessage CascadingWsMessage) {
+	var req PushRequest
+	var result PushResult
+	if err := json.Unmarshal(wsMessage.Pad, &req); err != nil || req.StreamPath == "" {
+		result.Error = "invalid push request"
+	} else {
+		result.Target = c.PushBase + escapeStreamPath(req.StreamPath)
+		log.Printf("server request push %s to %s", req.StreamPath, result.Target)
+		if err := ErWsCascadePlugin.Push(req.StreamPath, result.Target, NewWscPusher(c.Cc), false); err != nil {
+			result.Error = err.Error()
+		}
+	}
+
+	pad, _ := json.Marshal(result)
+	msgBytes, _ := json.Marshal(CascadingWsMessage{
+		Sn:   wsMessage.Sn,
+		Type: PushRsp,
+		Pad:  pad,
+	})
+	if err := c.writeMessage(ws.OpText, msgBytes); err != nil {
+		log.Printf("send push rsp: %v", err)
+	}
+}
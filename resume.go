@@ -0,0 +1,63 @@
+package erwscascade
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+/**
+	上级平台断线接续: 下级平台 WscPusher 重连后推送同一路流时, 在流的 publish timeout 内接续原发布者,
+	沿用原音视频轨道并按断线时长平移时间戳, 上级平台的订阅者不中断
+**/
+
+const (
+	resumeWaitTimeout  = 5 * time.Second // 等待原连接读取结束的最长时间
+	resumeStaleTimeout = 3 * time.Second // 原连接超过该时间没有数据视为已失效
+)
+
+// 上级平台: 同一下级平台推送同一路原始流且原连接已失效时，返回可接续的原接收端；
+// 原连接仍在正常接收时由 checkCollision 回复 StatusPushBusy，避免冒用 cid 的推流立即接续
+func findResumable(streamPath string, cid string, original string) *WssRecever {
+	receivedStreamsLock.RLock()
+	rs, ok := receivedStreams[streamPath]
+	receivedStreamsLock.RUnlock()
+	if !ok || rs.Cid != cid || rs.Original != original || rs.recever == nil {
+		return nil
+	}
+	// 流已关闭(超过 publish timeout)或已被其他发布者占用
+	s := Streams.Get(streamPath)
+	if s == nil || (s.Publisher != nil && s.Publisher != IPublisher(rs.recever)) {
+		return nil
+	}
+	if !rs.recever.isStale() {
+		return nil
+	}
+	return rs.recever
+}
+
+// 原连接已断开或超过 resumeStaleTimeout 没有收到数据
+func (recever *WssRecever) isStale() bool {
+	if recever.Status != 1 {
+		return true
+	}
+	last := atomic.LoadInt64(&recever.lastWrite)
+	return last == 0 || time.Since(time.Unix(0, last)) > resumeStaleTimeout
+}
+
+// 上级平台: 断开原连接(下级平台重连时原连接可能尚未检测到断开)，等待原发布者停止后接续时间戳
+func (recever *WssRecever) resume(old *WssRecever) {
+	if old.Status == 1 {
+		old.Info("cascade push reconnected, close old connection")
+	}
+	old.closeAndWait(0, "")
+	recever.absTS = old.absTS
+	// 订阅者保留在原流中
+	atomic.StoreInt32(&recever.subscribers, atomic.LoadInt32(&old.subscribers))
+	if last := atomic.LoadInt64(&old.lastWrite); last != 0 {
+		recever.absTS += uint32(time.Since(time.Unix(0, last)).Milliseconds())
+	}
+	ErWsCascadePlugin.Info("resume cascade publish", zap.String("streamPath", old.StreamPath), zap.Uint32("absTS", recever.absTS))
+}
@@ -0,0 +1,219 @@
+package erwscascade
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	WscPusher 发送队列: 上行带宽不足时队列积压, 超过长度后先丢弃非关键帧视频, 之后等待下一个关键帧, 仍然超长时丢弃队列中的关键帧,
+	音频与解码配置不丢弃, 避免延迟无限增长直至链接断开重连
+**/
+
+// 发送队列中一帧的类型，决定拥塞时的丢弃顺序
+type itemKind byte
+
+const (
+	itemConfig   itemKind = iota // 解码配置、init segment 等，不可丢弃
+	itemAudio                    // 音频，不丢弃
+	itemKeyframe                 // 视频关键帧，丢弃非关键帧后仍然超长时丢弃
+	itemVideo                    // 视频非关键帧，拥塞时最先丢弃
+)
+
+// 发送队列中的一帧，可能包含多个 ws 消息
+type sendItem struct {
+	data [][]byte
+	kind itemKind
+}
+
+// 发送统计，64 位字段在前保证 32 位平台原子操作对齐
+type sendStats struct {
+	sentFrames   uint64
+	sentBytes    uint64
+	droppedVideo uint64
+	depth        int32 // 当前队列长度
+	maxDepth     int32 // 最大队列长度
+}
+
+type sendQueue struct {
+	sync.Mutex
+	cond     *sync.Cond
+	items    []*sendItem
+	size     int
+	waitKey  bool // 丢帧后等待关键帧
+	dropping bool // 丢帧状态，进入与退出时记录日志
+	closed   bool
+	stats    *sendStats
+}
+
+func newSendQueue(size int, stats *sendStats) *sendQueue {
+	q := &sendQueue{size: size, stats: stats}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+func (q *sendQueue) drop() {
+	atomic.AddUint64(&q.stats.droppedVideo, 1)
+}
+
+// 入队，返回是否处于丢帧状态以及本次是否进入或退出丢帧状态
+func (q *sendQueue) push(item *sendItem) (dropping, changed bool) {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return false, false
+	}
+	was := q.dropping
+	if q.enqueue(item) {
+		q.dropping = true
+	} else if !q.waitKey {
+		// 收到关键帧后不再丢帧
+		q.dropping = false
+	}
+	q.updateDepth()
+	return q.dropping, q.dropping != was
+}
+
+// 入队，返回是否丢弃了帧
+func (q *sendQueue) enqueue(item *sendItem) (dropped bool) {
+	if item.kind == itemVideo && q.waitKey {
+		q.drop()
+		return true
+	}
+	if len(q.items) >= q.size {
+		// 先丢弃队列中的非关键帧视频，之后的视频等待关键帧
+		dropped = q.dropQueued(itemVideo) > 0
+		// 仍然超过长度时丢弃队列中的关键帧
+		if len(q.items) >= q.size && q.dropQueued(itemKeyframe) > 0 {
+			dropped = true
+		}
+		if item.kind == itemVideo {
+			q.waitKey = true
+			q.drop()
+			return true
+		}
+	}
+	if item.kind == itemKeyframe {
+		q.waitKey = false
+	}
+	q.items = append(q.items, item)
+	q.cond.Signal()
+	return
+}
+
+// 丢弃队列中指定类型的视频帧，之后等待关键帧，返回丢弃的帧数
+func (q *sendQueue) dropQueued(kind itemKind) (n int) {
+	items := q.items[:0]
+	for _, v := range q.items {
+		if v.kind == kind {
+			q.drop()
+			n++
+		} else {
+			items = append(items, v)
+		}
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = nil
+	}
+	q.items = items
+	if n > 0 {
+		q.waitKey = true
+	}
+	return
+}
+
+func (q *sendQueue) updateDepth() {
+	depth := int32(len(q.items))
+	atomic.StoreInt32(&q.stats.depth, depth)
+	if depth > atomic.LoadInt32(&q.stats.maxDepth) {
+		atomic.StoreInt32(&q.stats.maxDepth, depth)
+	}
+}
+
+// 阻塞出队，队列关闭后返回 false
+func (q *sendQueue) pop() (*sendItem, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.updateDepth()
+	return item, true
+}
+
+func (q *sendQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.items = nil
+	q.updateDepth()
+	q.cond.Broadcast()
+}
+
+// 推流统计
+type PushStats struct {
+	StreamPath   string `json:"streamPath"`
+	Target       string `json:"target"`
+	Format       string `json:"format"`
+	Level        string `json:"level,omitempty"` // 码率阶梯当前发送的本地流
+	QueueSize    int    `json:"queueSize"`
+	QueueDepth   int32  `json:"queueDepth"`
+	MaxDepth     int32  `json:"maxDepth"`
+	SentFrames   uint64 `json:"sentFrames"`
+	SentBytes    uint64 `json:"sentBytes"`
+	DroppedVideo uint64 `json:"droppedVideo"`
+}
+
+var (
+	wscPushers     = make(map[*WscPusher]struct{})
+	wscPushersLock sync.RWMutex
+)
+
+func addWscPusher(pusher *WscPusher) {
+	wscPushersLock.Lock()
+	defer wscPushersLock.Unlock()
+	wscPushers[pusher] = struct{}{}
+}
+
+func removeWscPusher(pusher *WscPusher) {
+	wscPushersLock.Lock()
+	defer wscPushersLock.Unlock()
+	delete(wscPushers, pusher)
+}
+
+/*
+下级平台正在推送的级联流发送队列与丢帧统计
+/erwscascade/api/pushstats
+*/
+func (p *ErWsCascadeConfig) API_pushstats(w http.ResponseWriter, r *http.Request) {
+	wscPushersLock.RLock()
+	list := make([]*PushStats, 0, len(wscPushers))
+	for pusher := range wscPushers {
+		stats := pusher.stats
+		list = append(list, &PushStats{
+			StreamPath:   pusher.StreamPath,
+			Target:       pusher.RemoteAddr,
+			Format:       pusher.format,
+			QueueSize:    pusher.Cc.SendQueue,
+			QueueDepth:   atomic.LoadInt32(&stats.depth),
+			MaxDepth:     atomic.LoadInt32(&stats.maxDepth),
+			SentFrames:   atomic.LoadUint64(&stats.sentFrames),
+			SentBytes:    atomic.LoadUint64(&stats.sentBytes),
+			DroppedVideo: atomic.LoadUint64(&stats.droppedVideo),
+		})
+		if l := pusher.ladder; l != nil {
+			_, list[len(list)-1].Level = l.current()
+		}
+	}
+	wscPushersLock.RUnlock()
+	util.ReturnValue(list, w, r)
+}
@@ -0,0 +1,118 @@
+package erwscascade
+
+import (
+	"testing"
+	"time"
+)
+
+func queuedKinds(q *sendQueue) []itemKind {
+	kinds := make([]itemKind, 0, len(q.items))
+	for _, item := range q.items {
+		kinds = append(kinds, item.kind)
+	}
+	return kinds
+}
+
+func TestSendQueueDrop(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		push         []itemKind
+		want         []itemKind
+		droppedVideo uint64
+	}{
+		{"under size", 3,
+			[]itemKind{itemConfig, itemKeyframe, itemVideo},
+			[]itemKind{itemConfig, itemKeyframe, itemVideo}, 0},
+		// 队列满时丢弃非关键帧视频，之后的视频等待关键帧
+		{"drop until keyframe", 5,
+			[]itemKind{itemConfig, itemKeyframe, itemVideo, itemVideo, itemAudio, itemVideo, itemVideo, itemKeyframe, itemVideo},
+			[]itemKind{itemConfig, itemKeyframe, itemAudio, itemKeyframe, itemVideo}, 4},
+		// 丢弃非关键帧后仍然超长时丢弃队列中的关键帧
+		{"drop queued keyframes", 3,
+			[]itemKind{itemConfig, itemKeyframe, itemAudio, itemAudio, itemVideo},
+			[]itemKind{itemConfig, itemAudio, itemAudio}, 2},
+		// 音频与解码配置不丢弃
+		{"keep audio", 2,
+			[]itemKind{itemConfig, itemAudio, itemAudio, itemAudio},
+			[]itemKind{itemConfig, itemAudio, itemAudio, itemAudio}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &sendStats{}
+			q := newSendQueue(tt.size, stats)
+			for _, kind := range tt.push {
+				q.push(&sendItem{kind: kind})
+			}
+			got := queuedKinds(q)
+			if len(got) != len(tt.want) {
+				t.Fatalf("queued = %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("queued = %v, want %v", got, tt.want)
+				}
+			}
+			if stats.droppedVideo != tt.droppedVideo {
+				t.Fatalf("dropped video %d, want %d", stats.droppedVideo, tt.droppedVideo)
+			}
+			if stats.depth != int32(len(tt.want)) {
+				t.Fatalf("depth = %d, want %d", stats.depth, len(tt.want))
+			}
+		})
+	}
+}
+
+// 只在进入与退出丢帧状态时返回 changed
+func TestSendQueuePushState(t *testing.T) {
+	q := newSendQueue(4, &sendStats{})
+	steps := []struct {
+		kind     itemKind
+		dropping bool
+		changed  bool
+	}{
+		{itemConfig, false, false},
+		{itemKeyframe, false, false},
+		{itemVideo, false, false},
+		{itemVideo, false, false},
+		{itemVideo, true, true},
+		{itemVideo, true, false},
+		{itemAudio, true, false}, // 仍在等待关键帧
+		{itemKeyframe, false, true},
+		{itemAudio, true, true}, // 队列中没有非关键帧，丢弃关键帧
+	}
+	for i, step := range steps {
+		dropping, changed := q.push(&sendItem{kind: step.kind})
+		if dropping != step.dropping || changed != step.changed {
+			t.Fatalf("push #%d = %v, %v, want %v, %v", i, dropping, changed, step.dropping, step.changed)
+		}
+	}
+}
+
+func TestSendQueuePopClose(t *testing.T) {
+	q := newSendQueue(3, &sendStats{})
+	q.push(&sendItem{kind: itemConfig})
+	q.push(&sendItem{kind: itemKeyframe})
+	for _, want := range []itemKind{itemConfig, itemKeyframe} {
+		if item, ok := q.pop(); !ok || item.kind != want {
+			t.Fatalf("pop() = %v, %v, want %v", item, ok, want)
+		}
+	}
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		done <- ok
+	}()
+	q.close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("pop() after close = true, want false")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pop() not woken by close")
+	}
+	if _, changed := q.push(&sendItem{kind: itemVideo}); changed {
+		t.Fatal("push() after close changed state")
+	}
+}
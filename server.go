@@ -8,79 +8,346 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
-var responseChan = make(chan CascadingWsMessage)
-
 type WsClientConn struct {
-	Conn    *net.Conn
-	RspChan chan CascadingWsMessage
-	CInfo   ClientInfo
+	Conn  *net.Conn
+	CInfo ClientInfo
+
+	writeLock   sync.Mutex            // 多个代理请求并发写同一个 ws 链接
+	pendingLock sync.Mutex            // 保护 pending
+	pending     map[int]*proxyPending // 等待响应的请求 sn -> 响应通道
+
+	catalog   clientCatalog // 下级平台流目录缓存
+	linkStats               // 下级平台链路 RTT 与最后活跃时间
+	done      chan struct{} // 链接断开时关闭
+}
+
+// 等待中的代理请求，分块响应时会收到多条消息
+type proxyPending struct {
+	ch   chan CascadingWsMessage
+	done chan struct{} // 请求方退出
+}
+
+// 每个请求的响应缓冲，不支持流控的旧版本下级平台分块回传时，请求方处理过慢导致缓冲满则取消该请求
+const proxyPendingQueue = 64
+
+// 分块回传的发送窗口，小于响应缓冲，下级平台按窗口发送时缓冲不会满
+const proxyStreamWindow = proxyPendingQueue / 2
+
+func NewWsClientConn(conn *net.Conn) *WsClientConn {
+	client := &WsClientConn{
+		Conn:    conn,
+		pending: make(map[int]*proxyPending),
+		done:    make(chan struct{}),
+	}
+	client.touch()
+	return client
+}
+
+// 串行写 ws 消息
+func (client *WsClientConn) writeMessage(op ws.OpCode, data []byte) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	return wsutil.WriteServerMessage(*client.Conn, op, data)
+}
+
+// 登记一个等待响应的请求
+func (client *WsClientConn) addPending(sn int) *proxyPending {
+	pend := &proxyPending{
+		ch:   make(chan CascadingWsMessage, proxyPendingQueue),
+		done: make(chan struct{}),
+	}
+	client.pendingLock.Lock()
+	client.pending[sn] = pend
+	client.pendingLock.Unlock()
+	return pend
+}
+
+// 请求方退出时调用
+func (client *WsClientConn) removePending(sn int, pend *proxyPending) {
+	client.pendingLock.Lock()
+	if client.pending[sn] == pend {
+		delete(client.pending, sn)
+	}
+	client.pendingLock.Unlock()
+	close(pend.done)
+}
+
+// 把响应分发给对应 sn 的请求，没有等待者(已超时)则丢弃
+func (client *WsClientConn) dispatchPending(msg CascadingWsMessage) bool {
+	client.pendingLock.Lock()
+	pend, ok := client.pending[msg.Sn]
+	client.pendingLock.Unlock()
+	if !ok {
+		return false
+	}
+
+	// 接收线程同时处理心跳等消息，不能阻塞
+	select {
+	case pend.ch <- msg:
+	case <-pend.done:
+	default:
+		// 下级平台不支持流控且请求方跟不上，终止该请求，避免阻塞整条控制链路
+		log.Printf("proxy sn:%v consumer too slow and client has no flow control, cancel\n", msg.Sn)
+		client.pendingLock.Lock()
+		delete(client.pending, msg.Sn)
+		client.pendingLock.Unlock()
+		close(pend.ch)
+		client.sendCancel(msg.Sn)
+	}
+	return true
+}
+
+// 通知下级平台取消请求
+func (client *WsClientConn) sendCancel(sn int) {
+	msgBytes, _ := json.Marshal(CascadingWsMessage{
+		Sn:   sn,
+		Type: HTTPProxyCancel,
+	})
+	if err := client.writeMessage(ws.OpText, msgBytes); err != nil {
+		log.Println("send cancel err:", err)
+	}
+}
+
+// 确认已写出的分块，下级平台补充发送窗口
+func (client *WsClientConn) sendAck(sn int, chunks int) {
+	pad, _ := json.Marshal(ProxyAckMessage{Chunks: chunks})
+	msgBytes, _ := json.Marshal(CascadingWsMessage{
+		Sn:   sn,
+		Type: HTTPProxyAck,
+		Pad:  pad,
+	})
+	if err := client.writeMessage(ws.OpText, msgBytes); err != nil {
+		log.Println("send ack err:", err)
+	}
+}
+
+// 链接断开，通知所有等待中的请求
+func (client *WsClientConn) closePending() {
+	client.pendingLock.Lock()
+	for sn, pend := range client.pending {
+		close(pend.ch)
+		delete(client.pending, sn)
+	}
+	client.pendingLock.Unlock()
 }
 
 var clientConnections = make(map[string]*WsClientConn)
 var connectionsThreads = make(map[string]chan struct{})
 var connectionsLock sync.RWMutex
 
-var gSn int = 0
+var gSn int64 = 0
+
+// 分配全局唯一的请求序号
+func nextSn() int {
+	return int(atomic.AddInt64(&gSn, 1))
+}
+
+// 逐跳头部，不应该透传给浏览器
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Trailer",
+	"Te",
+}
+
+// 按下级平台的响应回写状态码、响应头与内容
+func writeProxyRsp(w http.ResponseWriter, rsp *ProxyRspMessage) {
+	header := w.Header()
+	for key, values := range rsp.Header {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(rsp.Body)))
+	w.WriteHeader(rsp.Status)
+	w.Write(rsp.Body)
+}
 
-func (p *ErWsCascadeConfig) transWsProxyMessage(cid string, req ProxyMessage) ([]byte, error) {
+// 发送代理请求，返回等待响应的通道，调用方用完后需 removePending
+func (p *ErWsCascadeConfig) sendWsProxyMessage(cid string, req ProxyMessage) (*WsClientConn, int, *proxyPending, error) {
+	reqPad, _ := json.Marshal(req)
+	return p.sendWsRequest(cid, HTTPProxyReq, reqPad)
+}
+
+// 向下级平台发送请求消息并登记等待响应，调用方用完后需 removePending
+func (p *ErWsCascadeConfig) sendWsRequest(cid string, t MessageType, pad []byte) (*WsClientConn, int, *proxyPending, error) {
 	connectionsLock.Lock()
 	client, ok := clientConnections[cid]
 	connectionsLock.Unlock()
 
 	if !ok {
-		return nil, errors.New("no find client")
+		return nil, 0, nil, errors.New("no find client")
 	}
 
-	reqPad, _ := json.Marshal(req)
-
-	gSn++
 	reqMsg := CascadingWsMessage{
-		Sn:   gSn,
-		Type: HTTPProxyReq,
-		Pad:  reqPad,
+		Sn:   nextSn(),
+		Type: t,
+		Pad:  pad,
 	}
 	reqBytes, _ := json.Marshal(reqMsg)
 
 	log.Printf("server proxy msg sn:%v, type:%v\n", reqMsg.Sn, reqMsg.Type)
 
-	err := wsutil.WriteServerMessage(*client.Conn, ws.OpText, reqBytes)
+	// 先登记再发送，避免响应先于登记到达
+	pend := client.addPending(reqMsg.Sn)
+
+	err := client.writeMessage(ws.OpText, reqBytes)
 	if err != nil {
 		log.Println("WriteServerMessage err:", err)
+		client.removePending(reqMsg.Sn, pend)
+		return nil, 0, nil, err
+	}
+	return client, reqMsg.Sn, pend, nil
+}
+
+// 代理请求默认等待响应的超时时间
+const proxyRspTimeout = 10 * time.Second
+
+// 等待指定类型的响应消息
+func waitWsMessage(pend *proxyPending, t MessageType, d time.Duration) (*CascadingWsMessage, error) {
+	timeout := time.NewTimer(d)
+	defer timeout.Stop()
+
+	select {
+	case rspMsg, ok := <-pend.ch:
+		if !ok {
+			return nil, errors.New("client offline")
+		}
+		log.Printf("client rsp msg sn:%v, type:%v\n", rspMsg.Sn, rspMsg.Type)
+		if rspMsg.Type != t {
+			return nil, errors.New("unexpected rsp type " + rspMsg.Type.String())
+		}
+		return &rspMsg, nil
+	case <-timeout.C:
+		log.Printf("Timeout: No response received within %v\n", d)
+		return nil, errors.New("time out")
+	}
+}
+
+// 等待 HTTPProxyRsp
+func waitProxyRsp(pend *proxyPending, d time.Duration) (*ProxyRspMessage, error) {
+	rspMsg, err := waitWsMessage(pend, HTTPProxyRsp, d)
+	if err != nil {
 		return nil, err
 	}
+	return parseProxyRspMessage(rspMsg.Pad), nil
+}
 
-	// 设置超时时间为 10 秒
-	timeout := time.After(10 * time.Second)
+// 发送请求并等待响应
+func (p *ErWsCascadeConfig) requestClient(cid string, t MessageType, pad []byte, rspType MessageType, d time.Duration) (*CascadingWsMessage, error) {
+	client, sn, pend, err := p.sendWsRequest(cid, t, pad)
+	if err != nil {
+		return nil, err
+	}
+	defer client.removePending(sn, pend)
 
-	for {
-		select {
-		case rspMsg := <-client.RspChan:
+	return waitWsMessage(pend, rspType, d)
+}
 
-			log.Printf("client rsp msg sn:%v, type:%v\n", rspMsg.Sn, rspMsg.Type)
+func (p *ErWsCascadeConfig) transWsProxyMessage(cid string, req ProxyMessage) (*ProxyRspMessage, error) {
+	return p.transWsProxyMessageTimeout(cid, req, proxyRspTimeout)
+}
 
-			// 收到响应消息
-			if rspMsg.Sn == reqMsg.Sn {
-				return rspMsg.Pad, nil
-			} else {
-				//继续等超时
-				continue
-			}
-		case <-timeout:
-			log.Println("Timeout: No response received within 10 seconds")
-			return nil, errors.New("time out")
-		}
+func (p *ErWsCascadeConfig) transWsProxyMessageTimeout(cid string, req ProxyMessage, timeout time.Duration) (*ProxyRspMessage, error) {
+	req.Stream = false
+	client, sn, pend, err := p.sendWsProxyMessage(cid, req)
+	if err != nil {
+		return nil, err
 	}
+	defer client.removePending(sn, pend)
 
-	return nil, nil
+	return waitProxyRsp(pend, timeout)
+}
+
+// 代理请求并把响应写回 w，下级平台分块回传时边收边写，浏览器断开时通知下级平台取消
+func (p *ErWsCascadeConfig) streamWsProxyMessage(w http.ResponseWriter, r *http.Request, cid string, req ProxyMessage) error {
+	req.Stream = true
+	req.Window = proxyStreamWindow
+	client, sn, pend, err := p.sendWsProxyMessage(cid, req)
+	if err != nil {
+		return err
+	}
+	defer client.removePending(sn, pend)
+
+	rsp, err := waitProxyRsp(pend, proxyRspTimeout)
+	if err != nil {
+		client.sendCancel(sn)
+		return err
+	}
+	if !rsp.Stream {
+		writeProxyRsp(w, rsp)
+		return nil
+	}
+
+	header := w.Header()
+	for key, values := range rsp.Header {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+	header.Del("Content-Length")
+	w.WriteHeader(rsp.Status)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
 
+	// 写出半个窗口后确认一次，旧版本下级平台不回复 Window，不做流控
+	var acked int
+	for {
+		select {
+		case msg, ok := <-pend.ch:
+			if !ok {
+				log.Printf("proxy stream sn:%v interrupted\n", sn)
+				return nil
+			}
+			switch msg.Type {
+			case HTTPProxyChunk:
+				if _, err := w.Write(msg.Pad); err != nil {
+					client.sendCancel(sn)
+					return nil
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+				if rsp.Window > 0 {
+					if acked++; acked >= rsp.Window/2 {
+						client.sendAck(sn, acked)
+						acked = 0
+					}
+				}
+			case HTTPProxyEnd:
+				if len(msg.Pad) > 0 {
+					log.Printf("proxy stream sn:%v end with err:%s\n", sn, msg.Pad)
+				}
+				return nil
+			}
+		case <-r.Context().Done():
+			// 浏览器断开
+			log.Printf("proxy stream sn:%v canceled by browser\n", sn)
+			client.sendCancel(sn)
+			return nil
+		}
+	}
 }
 
 func (p *ErWsCascadeConfig) sendWsMessageToClient(cid string, message string) {
@@ -89,7 +356,7 @@ func (p *ErWsCascadeConfig) sendWsMessageToClient(cid string, message string) {
 	connectionsLock.Unlock()
 
 	if ok {
-		err := wsutil.WriteServerMessage(*client.Conn, ws.OpText, []byte(message))
+		err := client.writeMessage(ws.OpText, []byte(message))
 		if err != nil {
 			log.Println("Error sending message to client:", err)
 		}
@@ -103,7 +370,6 @@ func (p *ErWsCascadeConfig) receiveWsMessages(client *WsClientConn, cid string)
 			log.Println("Error reading message:", err)
 			break
 		}
-		log.Printf("Received message from client: %s\n", cid)
 		// Handle client messages here
 		//p.sendWsMessageToClient(cid, "Server RSP")
 
@@ -114,10 +380,14 @@ func (p *ErWsCascadeConfig) receiveWsMessages(client *WsClientConn, cid string)
 			log.Printf("Error decoding message: %v", err)
 			continue
 		}
+		client.touch()
 
-		if wsMessage.Type == HTTPProxyRsp {
-			//通知阻塞函数
-			client.RspChan <- wsMessage
+		if wsMessage.Type == HTTPProxyRsp || wsMessage.Type == HTTPProxyChunk || wsMessage.Type == HTTPProxyEnd ||
+			wsMessage.Type == PushRsp {
+			//通知对应 sn 的阻塞函数
+			if !client.dispatchPending(wsMessage) {
+				log.Printf("drop unexpected rsp sn:%v\n", wsMessage.Sn)
+			}
 
 		} else if wsMessage.Type == CInfo {
 			var clientInfo ClientInfo
@@ -128,6 +398,13 @@ func (p *ErWsCascadeConfig) receiveWsMessages(client *WsClientConn, cid string)
 			}
 			log.Println("Parsed ClientInfo:", clientInfo)
 			client.CInfo = clientInfo
+		} else if wsMessage.Type == Catalog || wsMessage.Type == CatalogEvent {
+			client.onCatalogMessage(wsMessage)
+		} else if wsMessage.Type == Ping {
+			client.onPing()
+			client.writeMessage(ws.OpText, newPongMessage(wsMessage))
+		} else if wsMessage.Type == Pong {
+			client.onPong(wsMessage.Pad)
 		} else {
 			log.Println("MessageType is:", wsMessage.Type.String())
 		}
@@ -137,9 +414,15 @@ func (p *ErWsCascadeConfig) receiveWsMessages(client *WsClientConn, cid string)
 	log.Printf("ws client offline cid: %s\n", cid)
 
 	// 断开连接时清理操作
+	close(client.done)
+	client.closePending()
 	connectionsLock.Lock()
-	delete(clientConnections, cid)
-	close(connectionsThreads[cid])
+	// 同一 cid 可能已经重新注册，只清理自己
+	if clientConnections[cid] == client {
+		delete(clientConnections, cid)
+		close(connectionsThreads[cid])
+		delete(connectionsThreads, cid)
+	}
 	connectionsLock.Unlock()
 }
 
@@ -178,29 +461,48 @@ func (p *ErWsCascadeConfig) Wsocket_(w http.ResponseWriter, r *http.Request) {
 			cid := queryParams.Get("cid")
 			log.Printf("CID value: %s\n", cid)
 
-			conn, _, _, err := ws.UpgradeHTTP(r, w)
-			if err != nil {
-				log.Printf("UpgradeHTTP error:%v", err)
+			if cid == "" {
+				log.Printf("invalid cid refuse connect\n")
+				http.Error(w, "invalid cid", http.StatusBadRequest)
 				return
 			}
 
-			if cid == "" {
-				log.Printf("invalid cid refuse connect\n")
-				conn.Close()
+			// 鉴权失败在升级 ws 之前拒绝
+			if err := p.verifyRegister(cid, r); err != nil {
+				log.Printf("register auth faild cid:%s err:%v\n", cid, err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
 			}
 
-			client := WsClientConn{
-				Conn:    &conn,
-				RspChan: make(chan CascadingWsMessage),
+			if err := p.checkClientCert(cid, r); err != nil {
+				log.Printf("register client cert faild cid:%s err:%v\n", cid, err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
 			}
+
+			conn, _, _, err := ws.UpgradeHTTP(r, w)
+			if err != nil {
+				log.Printf("UpgradeHTTP error:%v", err)
+				return
+			}
+
+			client := NewWsClientConn(&conn)
 			connectionsLock.Lock()
-			clientConnections[cid] = &client
+			if old, ok := clientConnections[cid]; ok {
+				// 同一 cid 重复注册，新链接替换旧链接；旧链接的接收线程不再清理，在此通知其退出
+				log.Printf("cid:%s re-register, close old connect\n", cid)
+				(*old.Conn).Close()
+				if stop, ok := connectionsThreads[cid]; ok {
+					close(stop)
+				}
+			}
+			clientConnections[cid] = client
 			connectionsThreads[cid] = make(chan struct{})
 			connectionsLock.Unlock()
 
 			// 启动线程接收客户端消息
-			go p.receiveWsMessages(&client, cid)
+			go p.receiveWsMessages(client, cid)
+			go p.keepAlive(client, cid)
 		}
 		return
 	} else {
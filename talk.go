@@ -0,0 +1,168 @@
+package erwscascade
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/util"
+)
+
+/**
+	级联对讲: 上级平台订阅本地的对讲流(只含音频), 通过级联流的 ws 链接把 flv 音频 tag 回传给下级平台,
+	下级平台把收到的音频发布为本地流 streamPath/talk, 供设备插件播放
+**/
+
+// 下级平台发布对讲流的后缀
+const talkSuffix = "/talk"
+
+// 对讲流发布失败后的重试间隔，期间收到的音频丢弃
+const talkRetryInterval = 10 * time.Second
+
+// 下级平台: 发布上级平台回传的音频
+type TalkPublisher struct {
+	Publisher
+}
+
+func NewTalkPublisher(cc *ErWsCascadeConfig) *TalkPublisher {
+	pub := new(TalkPublisher)
+	configCopy := cc.GetPublishConfig()
+	configCopy.PubAudio = true
+	configCopy.PubVideo = false
+	pub.Config = &configCopy
+	return pub
+}
+
+// 下级平台: 收到第一个音频 tag 时发布对讲流，失败后间隔 talkRetryInterval 再尝试
+func (pusher *WscPusher) talkPublisher() *TalkPublisher {
+	if pusher.talk != nil {
+		return pusher.talk
+	}
+	if time.Now().Before(pusher.talkRetryAt) {
+		return nil
+	}
+	talk := NewTalkPublisher(pusher.Cc)
+	talkPath := pusher.StreamPath + talkSuffix
+	if err := ErWsCascadePlugin.Publish(talkPath, talk); err != nil {
+		pusher.talkRetryAt = time.Now().Add(talkRetryInterval)
+		pusher.Error("publish talk", zap.String("streamPath", talkPath), zap.Duration("retry", talkRetryInterval), zap.Error(err))
+		return nil
+	}
+	pusher.Info("publish talk", zap.String("streamPath", talkPath))
+	pusher.talk = talk
+	return talk
+}
+
+// 下级平台: 推流断开时结束对讲流
+func (pusher *WscPusher) stopTalk() {
+	pusher.talkRetryAt = time.Time{}
+	if pusher.talk != nil {
+		pusher.talk.Stop(zap.String("reason", "cascade push end"))
+		pusher.talk = nil
+	}
+}
+
+// 上级平台: 订阅本地对讲流，把音频 tag 回传给下级平台
+type TalkSubscriber struct {
+	Subscriber
+	recever *WssRecever
+}
+
+func (sub *TalkSubscriber) OnEvent(event any) {
+	switch v := event.(type) {
+	case FLVFrame:
+		sub.recever.writeTalkTag(v)
+	default:
+		sub.Subscriber.OnEvent(event)
+	}
+}
+
+// 上级平台: 开始对讲，talkPath 为上级平台本地提供音频的流
+func (recever *WssRecever) startTalk(talkPath string) error {
+	recever.talkLock.Lock()
+	defer recever.talkLock.Unlock()
+	if recever.talk != nil {
+		return errors.New("talk already started")
+	}
+	sub := &TalkSubscriber{recever: recever}
+	configCopy := recever.Cc.GetSubscribeConfig()
+	configCopy.SubAudio = true
+	configCopy.SubVideo = false
+	sub.Config = &configCopy
+	if err := ErWsCascadePlugin.Subscribe(talkPath, sub); err != nil {
+		return err
+	}
+	recever.talk = sub
+	go func() {
+		sub.PlayFLV()
+		recever.talkLock.Lock()
+		if recever.talk == sub {
+			recever.talk = nil
+		}
+		recever.talkLock.Unlock()
+	}()
+	return nil
+}
+
+// 上级平台: 结束对讲
+func (recever *WssRecever) stopTalk() {
+	recever.talkLock.Lock()
+	defer recever.talkLock.Unlock()
+	if recever.talk != nil {
+		recever.talk.Stop(zap.String("reason", "talk stop"))
+		recever.talk = nil
+	}
+}
+
+// 上级平台: 只回传音频 tag
+func (recever *WssRecever) writeTalkTag(tag FLVFrame) {
+	var data []byte
+	for _, buf := range net.Buffers(tag) {
+		data = append(data, buf...)
+	}
+	if len(data) == 0 || data[0] != codec.FLV_TAG_TYPE_AUDIO {
+		return
+	}
+	recever.writeLock.Lock()
+	defer recever.writeLock.Unlock()
+	if err := ws.WriteFrame(*recever.Conn, ws.NewBinaryFrame(data)); err != nil {
+		recever.Error("write talk", zap.Error(err))
+		go recever.stopTalk()
+	}
+}
+
+/*
+上级平台对讲接口, 把本地对讲流的音频回传给级联流对应的下级平台, 下级平台发布为 原始流/talk
+
+/erwscascade/api/talk?streamPath=[上级平台级联流]&talkPath=[上级平台对讲流,默认 streamPath/talk]&stop=[可选,结束对讲]
+*/
+func (p *ErWsCascadeConfig) API_talk(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	streamPath := query.Get("streamPath")
+	receivedStreamsLock.RLock()
+	rs, ok := receivedStreams[streamPath]
+	receivedStreamsLock.RUnlock()
+	if !ok || rs.recever == nil {
+		util.ReturnError(util.APIErrorNoStream, "no cascade stream "+streamPath, w, r)
+		return
+	}
+	if query.Has("stop") {
+		rs.recever.stopTalk()
+		util.ReturnOK(w, r)
+		return
+	}
+	talkPath := query.Get("talkPath")
+	if talkPath == "" {
+		talkPath = streamPath + talkSuffix
+	}
+	if err := rs.recever.startTalk(talkPath); err != nil {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
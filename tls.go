@@ -0,0 +1,252 @@
+package erwscascade
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+)
+
+/**
+	级联链路 tls 配置
+	下级平台: 校验上级平台证书(CA 或证书指纹), 可选客户端证书(双向认证)
+	上级平台: 校验下级平台客户端证书, 证书 subject 映射为 cid; 引擎 https 监听不请求客户端证书,
+	配置 clientca 时由插件在 mtls.listenaddr 单独监听注册与推流接口
+**/
+
+// 双向认证监听
+type MTLSConfig struct {
+	ListenAddr string `default:"" desc:"双向认证监听地址,如:8451" yaml:"listenaddr"`
+	CertFile   string `default:"" desc:"服务端证书,为空使用引擎https证书" yaml:"certfile"`
+	KeyFile    string `default:"" desc:"服务端证书私钥" yaml:"keyfile"`
+}
+
+// 启动时加载的 clientca，加载失败时拒绝全部注册与推流
+var (
+	clientCAPool *x509.CertPool
+	clientCAErr  error
+)
+
+// 读取 CA 文件，没有有效证书时返回错误
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid cert in " + file)
+	}
+	return pool, nil
+}
+
+// 下级平台连接上级平台的 tls 配置
+func (s *ServerConfig) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: s.Insecure,
+	}
+	if s.CAFile != "" {
+		pool, err := loadCertPool(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if s.Fingerprint != "" {
+		// 证书锁定: 校验证书指纹，支持自签名证书；同时配置 cafile 时先按 CA 校验证书链
+		fingerprint := normalizeFingerprint(s.Fingerprint)
+		roots := tlsConfig.RootCAs
+		if s.Insecure {
+			roots = nil
+		}
+		host := s.Host
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no server certificate")
+			}
+			if roots != nil {
+				if err := verifyCertChain(rawCerts, roots, host); err != nil {
+					return err
+				}
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if hex.EncodeToString(sum[:]) != fingerprint {
+				return errors.New("server certificate fingerprint mismatch")
+			}
+			return nil
+		}
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// 按 CA 校验证书链与主机名，证书锁定时默认校验已跳过
+func verifyCertChain(rawCerts [][]byte, roots *x509.CertPool, host string) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// 上级平台地址 host:port，用于匹配推流地址使用的 tls 配置
+func (s *ServerConfig) HostPort() string {
+	port := s.Port
+	if port == 0 {
+		port = 443
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// sha256 指纹统一为小写无分隔符格式，兼容 AA:BB:.. 写法
+func normalizeFingerprint(f string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(f))
+}
+
+// 按推流地址匹配上级平台配置，未匹配到时使用系统根证书校验
+func (p *ErWsCascadeConfig) tlsConfigFor(rawURL string) (*tls.Config, error) {
+	s, err := p.serverConfigFor(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return s.TLSConfig()
+	}
+	return &tls.Config{}, nil
+}
+
+// 按推流地址的 host:port 匹配上级平台配置，未匹配时返回 nil
+func (p *ErWsCascadeConfig) serverConfigFor(rawURL string) (*ServerConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "ws" || u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	hostPort := net.JoinHostPort(u.Hostname(), port)
+	for i := range p.ServerConfig {
+		if p.ServerConfig[i].HostPort() == hostPort {
+			return &p.ServerConfig[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// 上级平台校验下级平台客户端证书，返回证书对应的 cid；未配置 clientca 时返回空
+func (p *ErWsCascadeConfig) verifyClientCert(r *http.Request) (string, error) {
+	if p.ClientCA == "" {
+		return "", nil
+	}
+	if clientCAErr != nil {
+		return "", clientCAErr
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("client certificate required")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         clientCAPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+	subject := leaf.Subject.CommonName
+	if cid, ok := p.CertCid[subject]; ok {
+		return cid, nil
+	}
+	return subject, nil
+}
+
+// 校验客户端证书与请求中的 cid 一致
+func (p *ErWsCascadeConfig) checkClientCert(cid string, r *http.Request) error {
+	certCid, err := p.verifyClientCert(r)
+	if err != nil {
+		return err
+	}
+	if certCid != "" && certCid != cid {
+		return errors.New("client certificate not match cid")
+	}
+	return nil
+}
+
+// 上级平台: 加载 clientca 并启动双向认证监听
+func (p *ErWsCascadeConfig) setupClientCA() {
+	if p.ClientCA == "" {
+		return
+	}
+	if clientCAPool, clientCAErr = loadCertPool(p.ClientCA); clientCAErr != nil {
+		ErWsCascadePlugin.Error("load clientca faild, reject all register and wspush", zap.String("clientca", p.ClientCA), zap.Error(clientCAErr))
+		return
+	}
+	if p.MTLS.ListenAddr == "" {
+		ErWsCascadePlugin.Warn("clientca without mtls.listenaddr, engine https listener does not request client certificates")
+		return
+	}
+	go p.listenMTLS()
+}
+
+// 双向认证监听，只提供注册与推流接口，请求客户端证书并按 clientca 校验
+func (p *ErWsCascadeConfig) listenMTLS() {
+	certFile, keyFile := p.MTLS.CertFile, p.MTLS.KeyFile
+	if certFile == "" {
+		certFile, keyFile = EngineConfig.HTTP.CertFile, EngineConfig.HTTP.KeyFile
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/erwscascade/wsocket/", p.Wsocket_)
+	mux.HandleFunc("/erwscascade/wspush/", p.Wspush_)
+	server := &http.Server{
+		Addr:    p.MTLS.ListenAddr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			ClientCAs:  clientCAPool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		},
+		// ws 升级需要 http/1.1
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	ErWsCascadePlugin.Info("mtls listen", zap.String("addr", p.MTLS.ListenAddr))
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+		ErWsCascadePlugin.Error("mtls listen", zap.String("addr", p.MTLS.ListenAddr), zap.Error(err))
+	}
+}
@@ -0,0 +1,824 @@
+package erwscascade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"m7s.live/engine/v4/codec"
+)
+
+/**
+	MPEG-TS 级联媒体格式, 推流地址参数 format=ts 选择, 上级平台未指定时按首字节(0x47)识别
+	推流端把订阅到的 flv tag 封装为 PES, 每帧的 188 字节 TS 包合并为一个 ws 消息发送, 关键帧前插入 PAT/PMT
+	上级平台按 188 字节解析(丢包时重新同步), 解封装后转换为 flv tag 发布, 支持 H264、H265、AAC、G711
+**/
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	tsPidPAT   = 0x0000
+	tsPidPMT   = 0x1000
+	tsPidVideo = 0x0100
+	tsPidAudio = 0x0101
+)
+
+// PMT stream_type
+const (
+	tsStreamAAC   = 0x0F
+	tsStreamH264  = 0x1B
+	tsStreamH265  = 0x24
+	tsStreamG711A = 0x90
+	tsStreamG711U = 0x91
+)
+
+// 33 位 PTS/DTS 回绕
+const tsTimestampWrap = 1 << 33
+
+var crc32MPEGTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// 推流端: flv tag 封装为 TS
+type tsMuxer struct {
+	videoType, audioType byte
+	videoParams          [][]byte // SPS PPS(VPS) 关键帧前插入
+	asc                  []byte
+
+	pmtVersion byte
+	ready      bool
+	waitKey    bool
+	cc         [0x2000]byte
+}
+
+// 写入一个 flv tag，返回该帧的 TS 包
+func (m *tsMuxer) writeTag(t byte, ts uint32, p []byte, hasVideo, hasAudio bool) []byte {
+	switch t {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		return m.writeVideo(ts, p, hasVideo, hasAudio)
+	case codec.FLV_TAG_TYPE_AUDIO:
+		return m.writeAudio(ts, p, hasVideo, hasAudio)
+	}
+	return nil
+}
+
+// 音视频轨道就绪后才开始发送
+func (m *tsMuxer) checkReady(hasVideo, hasAudio bool) bool {
+	if !m.ready {
+		if (hasVideo && m.videoParams == nil) || (hasAudio && m.audioType == 0) {
+			return false
+		}
+		m.ready, m.waitKey = true, m.videoType != 0
+	}
+	return true
+}
+
+// 轨道变化时 PMT 版本加一，并等待关键帧
+func (m *tsMuxer) reset() {
+	m.ready = false
+	m.pmtVersion = (m.pmtVersion + 1) & 0x1F
+}
+
+func (m *tsMuxer) writeVideo(ts uint32, p []byte, hasVideo, hasAudio bool) []byte {
+	if len(p) < 5 {
+		return nil
+	}
+	var streamType byte
+	switch p[0] & 0x0F {
+	case flvVideoH264:
+		streamType = tsStreamH264
+	case legacyVideoH265:
+		streamType = tsStreamH265
+	default:
+		return nil
+	}
+	key := p[0]>>4 == 1
+	switch p[1] {
+	case 0:
+		params := parseDecoderConfig(streamType, p[5:])
+		if streamType != m.videoType || !equalParams(params, m.videoParams) {
+			m.videoType, m.videoParams = streamType, params
+			m.reset()
+		}
+		return nil
+	case 1:
+	default:
+		return nil
+	}
+	if m.videoParams == nil || !m.checkReady(hasVideo, hasAudio) {
+		return nil
+	}
+	if m.waitKey {
+		if !key {
+			return nil
+		}
+		m.waitKey = false
+	}
+	cts := int32(uint32(p[2])<<16|uint32(p[3])<<8|uint32(p[4])) << 8 >> 8
+
+	var frame bytes.Buffer
+	startCode := []byte{0, 0, 0, 1}
+	if streamType == tsStreamH264 {
+		frame.Write([]byte{0, 0, 0, 1, 0x09, 0xF0})
+	} else {
+		frame.Write([]byte{0, 0, 0, 1, 0x46, 0x01, 0x50})
+	}
+	if key {
+		for _, param := range m.videoParams {
+			frame.Write(startCode)
+			frame.Write(param)
+		}
+	}
+	for data := p[5:]; len(data) >= 4; {
+		size := int(binary.BigEndian.Uint32(data))
+		if size > len(data)-4 {
+			break
+		}
+		nalu := data[4 : 4+size]
+		data = data[4+size:]
+		if size == 0 || isAUD(streamType, nalu[0]) {
+			continue
+		}
+		frame.Write(startCode)
+		frame.Write(nalu)
+	}
+
+	var out []byte
+	if key {
+		out = append(m.patPacket(), m.pmtPacket()...)
+	}
+	dts := uint64(ts) * 90
+	pts := uint64(int64(ts)+int64(cts)) * 90
+	return append(out, m.pes(tsPidVideo, 0xE0, pts, dts, true, key, frame.Bytes())...)
+}
+
+func (m *tsMuxer) writeAudio(ts uint32, p []byte, hasVideo, hasAudio bool) []byte {
+	if len(p) < 2 {
+		return nil
+	}
+	var data []byte
+	switch p[0] >> 4 {
+	case flvAudioAAC:
+		if p[1] == 0 {
+			if m.audioType != tsStreamAAC || !bytes.Equal(m.asc, p[2:]) {
+				m.audioType, m.asc = tsStreamAAC, append([]byte{}, p[2:]...)
+				m.reset()
+			}
+			return nil
+		}
+		if m.audioType != tsStreamAAC || len(m.asc) < 2 {
+			return nil
+		}
+		data = append(adtsHeader(m.asc, len(p)-2), p[2:]...)
+	case flvAudioPCMA, flvAudioPCMU:
+		streamType := byte(tsStreamG711A)
+		if p[0]>>4 == flvAudioPCMU {
+			streamType = tsStreamG711U
+		}
+		if m.audioType != streamType {
+			m.audioType = streamType
+			m.reset()
+		}
+		data = p[1:]
+	default:
+		return nil
+	}
+	if !m.checkReady(hasVideo, hasAudio) {
+		return nil
+	}
+	var out []byte
+	if m.videoType == 0 {
+		// 纯音频时每帧带 PAT/PMT 与 PCR
+		out = append(m.patPacket(), m.pmtPacket()...)
+	}
+	pts := uint64(ts) * 90
+	return append(out, m.pes(tsPidAudio, 0xC0, pts, pts, m.videoType == 0, false, data)...)
+}
+
+func isAUD(streamType byte, header byte) bool {
+	if streamType == tsStreamH264 {
+		return header&0x1F == 9
+	}
+	return (header>>1)&0x3F == 35
+}
+
+func equalParams(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 从 avcC、hvcC 取出参数集
+func parseDecoderConfig(streamType byte, b []byte) (params [][]byte) {
+	next := func() []byte {
+		if len(b) < 2 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(b))
+		if size > len(b)-2 {
+			b = nil
+			return nil
+		}
+		nalu := b[2 : 2+size]
+		b = b[2+size:]
+		return nalu
+	}
+	if streamType == tsStreamH264 {
+		if len(b) < 6 {
+			return nil
+		}
+		count := int(b[5] & 0x1F)
+		b = b[6:]
+		for i := 0; i < count; i++ {
+			params = append(params, next())
+		}
+		if len(b) < 1 {
+			return
+		}
+		count = int(b[0])
+		b = b[1:]
+		for i := 0; i < count; i++ {
+			params = append(params, next())
+		}
+		return
+	}
+	if len(b) < 23 {
+		return nil
+	}
+	arrays := int(b[22])
+	b = b[23:]
+	for i := 0; i < arrays && len(b) >= 3; i++ {
+		count := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		for j := 0; j < count; j++ {
+			params = append(params, next())
+		}
+	}
+	return
+}
+
+// AudioSpecificConfig 生成 ADTS 头
+func adtsHeader(asc []byte, size int) []byte {
+	profile := asc[0]>>3 - 1
+	freq := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0F
+	frameLen := 7 + size
+	return []byte{
+		0xFF, 0xF1,
+		profile<<6 | freq<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(frameLen>>11),
+		byte(frameLen >> 3),
+		byte(frameLen&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+func tsTimestamp(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0E | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xFE | 1,
+		byte(ts >> 7),
+		byte(ts<<1)&0xFE | 1,
+	}
+}
+
+// PES 切分为 TS 包，pcr 为 true 时第一个包携带 PCR
+func (m *tsMuxer) pes(pid uint16, streamID byte, pts, dts uint64, pcr, key bool, data []byte) []byte {
+	pts, dts = pts%tsTimestampWrap, dts%tsTimestampWrap
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80}
+	if pts != dts {
+		header = append(header, 0xC0, 10)
+		header = append(header, tsTimestamp(3, pts)...)
+		header = append(header, tsTimestamp(1, dts)...)
+	} else {
+		header = append(header, 0x80, 5)
+		header = append(header, tsTimestamp(2, pts)...)
+	}
+	if size := len(header) - 6 + len(data); streamID != 0xE0 && size <= 0xFFFF {
+		binary.BigEndian.PutUint16(header[4:], uint16(size))
+	}
+	payload := append(header, data...)
+
+	var out []byte
+	for first := true; len(payload) > 0; first = false {
+		var af []byte
+		if first && (pcr || key) {
+			flags := byte(0)
+			if key {
+				flags |= 0x40 // random_access_indicator
+			}
+			af = []byte{flags}
+			if pcr {
+				af[0] |= 0x10
+				af = append(af, byte(dts>>25), byte(dts>>17), byte(dts>>9), byte(dts>>1), byte(dts<<7)|0x7E, 0)
+			}
+		}
+		n := m.packet(&out, pid, first, af, payload)
+		payload = payload[n:]
+	}
+	return out
+}
+
+// 写入一个 TS 包，不足 188 字节时在自适应字段中填充，返回写入的负载长度
+func (m *tsMuxer) packet(out *[]byte, pid uint16, pusi bool, af []byte, payload []byte) int {
+	avail := tsPacketSize - 4
+	if af != nil {
+		avail -= 1 + len(af)
+	}
+	if len(payload) < avail {
+		stuff := avail - len(payload)
+		if af == nil {
+			if stuff == 1 {
+				af = []byte{}
+			} else {
+				af = append([]byte{0}, bytes.Repeat([]byte{0xFF}, stuff-2)...)
+			}
+		} else {
+			af = append(af, bytes.Repeat([]byte{0xFF}, stuff)...)
+		}
+		avail = len(payload)
+	}
+	pkt := make([]byte, 4, tsPacketSize)
+	pkt[0] = tsSyncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.cc[pid]
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0F
+	if af != nil {
+		pkt[3] |= 0x20
+		pkt = append(pkt, byte(len(af)))
+		pkt = append(pkt, af...)
+	}
+	pkt = append(pkt, payload[:avail]...)
+	*out = append(*out, pkt...)
+	return avail
+}
+
+// PSI 表封装为单个 TS 包
+func (m *tsMuxer) section(pid uint16, tableID byte, body []byte) []byte {
+	sec := []byte{tableID, 0xB0, 0}
+	binary.BigEndian.PutUint16(sec[1:], 0xB000|uint16(len(body)+4))
+	sec = append(sec, body...)
+	sec = binary.BigEndian.AppendUint32(sec, crc32MPEG(sec))
+	payload := append([]byte{0}, sec...)
+	payload = append(payload, bytes.Repeat([]byte{0xFF}, tsPacketSize-4-len(payload))...)
+	var out []byte
+	m.packet(&out, pid, true, nil, payload)
+	return out
+}
+
+func (m *tsMuxer) patPacket() []byte {
+	return m.section(tsPidPAT, 0x00, []byte{0, 1, 0xC1, 0, 0, 0, 1, 0xE0 | tsPidPMT>>8, tsPidPMT & 0xFF})
+}
+
+func (m *tsMuxer) pmtPacket() []byte {
+	pcrPid := uint16(tsPidVideo)
+	if m.videoType == 0 {
+		pcrPid = tsPidAudio
+	}
+	body := []byte{0, 1, 0xC1 | m.pmtVersion<<1, 0, 0}
+	body = binary.BigEndian.AppendUint16(body, 0xE000|pcrPid)
+	body = append(body, 0xF0, 0)
+	for _, s := range []struct {
+		streamType byte
+		pid        uint16
+	}{{m.videoType, tsPidVideo}, {m.audioType, tsPidAudio}} {
+		if s.streamType != 0 {
+			body = append(body, s.streamType)
+			body = binary.BigEndian.AppendUint16(body, 0xE000|s.pid)
+			body = append(body, 0xF0, 0)
+		}
+	}
+	return m.section(tsPidPMT, 0x02, body)
+}
+
+type tsStream struct {
+	streamType byte
+	pes        []byte
+
+	params  map[byte][]byte // 视频参数集 nal 类型 -> nal
+	config  []byte          // 已发布的解码配置
+	lastRaw uint64          // 上一个 33 位时间戳
+	wrap    uint64          // 回绕累计
+}
+
+// 上级平台: TS 解封装为 flv tag
+type tsDemuxer struct {
+	pmtPid  uint16
+	streams map[uint16]*tsStream
+	onTag   func(t byte, ts uint32, payload []byte)
+}
+
+func newTSDemuxer(onTag func(t byte, ts uint32, payload []byte)) *tsDemuxer {
+	return &tsDemuxer{
+		pmtPid:  0x1FFF,
+		streams: make(map[uint16]*tsStream),
+		onTag:   onTag,
+	}
+}
+
+// 连续多少个包的同步字节正确才认为已同步
+const tsSyncPackets = 3
+
+// 阻塞读取 TS 字节流，失去同步时逐字节查找连续 3 个间隔 188 字节的 0x47，
+// 避免把负载中的 0x47 当作包头
+func (d *tsDemuxer) read(r io.Reader) error {
+	br := bufio.NewReaderSize(r, tsPacketSize*tsSyncPackets)
+	pkt := make([]byte, tsPacketSize)
+	synced := false
+	for {
+		if synced {
+			head, err := br.Peek(1)
+			if err != nil {
+				return err
+			}
+			synced = head[0] == tsSyncByte
+		}
+		if !synced {
+			head, err := br.Peek(tsPacketSize*(tsSyncPackets-1) + 1)
+			if err != nil {
+				return err
+			}
+			if !isTSSynced(head) {
+				br.Discard(1)
+				continue
+			}
+			synced = true
+		}
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			return err
+		}
+		d.packet(pkt)
+	}
+}
+
+func isTSSynced(head []byte) bool {
+	for i := 0; i < tsSyncPackets; i++ {
+		if head[i*tsPacketSize] != tsSyncByte {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *tsDemuxer) packet(pkt []byte) {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+	offset := 4
+	if afc&0x02 != 0 {
+		offset += 1 + int(pkt[4])
+	}
+	if afc&0x01 == 0 || offset >= tsPacketSize {
+		return
+	}
+	payload := pkt[offset:]
+	switch {
+	case pid == tsPidPAT:
+		if body := psiSection(payload, 0x00); len(body) >= 9 {
+			for entries := body[5 : len(body)-4]; len(entries) >= 4; entries = entries[4:] {
+				if binary.BigEndian.Uint16(entries) != 0 {
+					d.pmtPid = binary.BigEndian.Uint16(entries[2:]) & 0x1FFF
+					break
+				}
+			}
+		}
+	case pid == d.pmtPid:
+		if body := psiSection(payload, 0x02); len(body) >= 13 {
+			d.parsePMT(body)
+		}
+	default:
+		st := d.streams[pid]
+		if st == nil {
+			return
+		}
+		if pusi {
+			d.flush(st)
+			st.pes = append([]byte{}, payload...)
+		} else if st.pes != nil {
+			st.pes = append(st.pes, payload...)
+		}
+		// 已知长度的 PES 收齐后立即处理
+		if len(st.pes) >= 6 {
+			if size := int(binary.BigEndian.Uint16(st.pes[4:])); size > 0 && len(st.pes) >= 6+size {
+				d.flush(st)
+			}
+		}
+	}
+}
+
+// 取出 PSI 表内容(含 CRC)
+func psiSection(payload []byte, tableID byte) []byte {
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	sec := payload[1+int(payload[0]):]
+	if len(sec) < 3 || sec[0] != tableID {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint16(sec[1:]) & 0x0FFF)
+	if 3+size > len(sec) || size < 4 {
+		return nil
+	}
+	if crc32MPEG(sec[:3+size]) != 0 {
+		return nil
+	}
+	return sec[3 : 3+size]
+}
+
+func (d *tsDemuxer) parsePMT(body []byte) {
+	infoLen := int(binary.BigEndian.Uint16(body[7:]) & 0x0FFF)
+	if 9+infoLen > len(body)-4 {
+		return
+	}
+	streams := make(map[uint16]*tsStream)
+	for entries := body[9+infoLen : len(body)-4]; len(entries) >= 5; {
+		streamType := entries[0]
+		pid := binary.BigEndian.Uint16(entries[1:]) & 0x1FFF
+		esLen := int(binary.BigEndian.Uint16(entries[3:]) & 0x0FFF)
+		if 5+esLen > len(entries) {
+			break
+		}
+		entries = entries[5+esLen:]
+		switch streamType {
+		case tsStreamH264, tsStreamH265, tsStreamAAC, tsStreamG711A, tsStreamG711U:
+		default:
+			continue
+		}
+		if st := d.streams[pid]; st != nil && st.streamType == streamType {
+			streams[pid] = st
+		} else {
+			streams[pid] = &tsStream{streamType: streamType, params: make(map[byte][]byte)}
+		}
+	}
+	d.streams = streams
+}
+
+// 33 位时间戳展开并转换为毫秒
+func (st *tsStream) millis(raw uint64) uint32 {
+	if raw < st.lastRaw && st.lastRaw-raw > tsTimestampWrap/2 {
+		st.wrap += tsTimestampWrap
+	}
+	st.lastRaw = raw
+	return uint32((raw + st.wrap) / 90)
+}
+
+func parseTSTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+func (d *tsDemuxer) flush(st *tsStream) {
+	pes := st.pes
+	st.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	if size := int(binary.BigEndian.Uint16(pes[4:])); size > 0 && 6+size < len(pes) {
+		pes = pes[:6+size]
+	}
+	flags, headerLen := pes[7], int(pes[8])
+	if 9+headerLen > len(pes) {
+		return
+	}
+	var pts, dts uint64
+	if flags&0x80 != 0 && headerLen >= 5 {
+		pts = parseTSTimestamp(pes[9:])
+		dts = pts
+	}
+	if flags&0x40 != 0 && headerLen >= 10 {
+		dts = parseTSTimestamp(pes[14:])
+	}
+	data := pes[9+headerLen:]
+	dtsMs := st.millis(dts)
+	cts := int32((int64(pts) - int64(dts)) / 90)
+	switch st.streamType {
+	case tsStreamH264, tsStreamH265:
+		d.writeVideo(st, dtsMs, cts, data)
+	case tsStreamAAC:
+		d.writeADTS(st, dtsMs, data)
+	case tsStreamG711A:
+		d.onTag(codec.FLV_TAG_TYPE_AUDIO, dtsMs, append([]byte{flvAudioPCMA<<4 | 0x02}, data...))
+	case tsStreamG711U:
+		d.onTag(codec.FLV_TAG_TYPE_AUDIO, dtsMs, append([]byte{flvAudioPCMU<<4 | 0x02}, data...))
+	}
+}
+
+// 按起始码切分 Annex B
+func splitAnnexB(b []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(b); {
+		if b[i] == 0 && b[i+1] == 0 && b[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				if end > start && b[end-1] == 0 {
+					end--
+				}
+				nalus = append(nalus, b[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return
+}
+
+func (d *tsDemuxer) writeVideo(st *tsStream, dts uint32, cts int32, data []byte) {
+	h265 := st.streamType == tsStreamH265
+	codecID := byte(flvVideoH264)
+	if h265 {
+		codecID = legacyVideoH265
+	}
+	key := false
+	var frame []byte
+	for _, nalu := range splitAnnexB(data) {
+		if len(nalu) == 0 {
+			continue
+		}
+		var naluType byte
+		if h265 {
+			naluType = (nalu[0] >> 1) & 0x3F
+			switch {
+			case naluType >= 32 && naluType <= 34: // VPS SPS PPS
+				st.params[naluType] = append([]byte{}, nalu...)
+				continue
+			case naluType == 35: // AUD
+				continue
+			case naluType >= 16 && naluType <= 21:
+				key = true
+			}
+		} else {
+			naluType = nalu[0] & 0x1F
+			switch naluType {
+			case 7, 8: // SPS PPS
+				st.params[naluType] = append([]byte{}, nalu...)
+				continue
+			case 9: // AUD
+				continue
+			case 5:
+				key = true
+			}
+		}
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(nalu)))
+		frame = append(frame, nalu...)
+	}
+	// 参数集变化时发布新的解码配置
+	var config []byte
+	if h265 {
+		config = buildHVCC(st.params[32], st.params[33], st.params[34])
+	} else {
+		config = buildAVCC(st.params[7], st.params[8])
+	}
+	if config != nil && !bytes.Equal(config, st.config) {
+		st.config = config
+		d.onTag(codec.FLV_TAG_TYPE_VIDEO, dts, append([]byte{0x10 | codecID, 0, 0, 0, 0}, config...))
+	}
+	if st.config == nil || frame == nil {
+		return
+	}
+	frameType := byte(0x20)
+	if key {
+		frameType = 0x10
+	}
+	d.onTag(codec.FLV_TAG_TYPE_VIDEO, dts, append([]byte{frameType | codecID, 1, byte(cts >> 16), byte(cts >> 8), byte(cts)}, frame...))
+}
+
+func buildAVCC(sps, pps []byte) []byte {
+	if len(sps) < 4 || len(pps) == 0 {
+		return nil
+	}
+	b := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(pps)))
+	return append(b, pps...)
+}
+
+// 去除防竞争字节
+func naluToRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, v := range nalu {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, v)
+	}
+	return rbsp
+}
+
+func buildHVCC(vps, sps, pps []byte) []byte {
+	if len(vps) == 0 || len(pps) == 0 {
+		return nil
+	}
+	// SPS: nal 头 2 字节，1 字节(vps id、sub layers、nesting)，之后 12 字节 profile_tier_level
+	rbsp := naluToRBSP(sps)
+	if len(rbsp) < 15 {
+		return nil
+	}
+	ptl := rbsp[3:15]
+	b := []byte{1}
+	b = append(b, ptl...)
+	b = append(b, 0xF0, 0x00, 0xFC, 0xFD, 0xF8, 0xF8, 0, 0, 0x0F, 3)
+	for _, param := range []struct {
+		naluType byte
+		nalu     []byte
+	}{{32, vps}, {33, sps}, {34, pps}} {
+		b = append(b, 0x80|param.naluType, 0, 1)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(param.nalu)))
+		b = append(b, param.nalu...)
+	}
+	return b
+}
+
+// ADTS 转换为 AudioSpecificConfig 与裸 AAC 帧
+func (d *tsDemuxer) writeADTS(st *tsStream, dts uint32, data []byte) {
+	for i := 0; len(data) >= 7; i++ {
+		if data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+			return
+		}
+		headerLen := 7
+		if data[1]&0x01 == 0 {
+			headerLen = 9
+		}
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if frameLen < headerLen || frameLen > len(data) {
+			return
+		}
+		profile := data[2] >> 6
+		freq := (data[2] >> 2) & 0x0F
+		channels := (data[2]&0x01)<<2 | data[3]>>6
+		asc := []byte{(profile+1)<<3 | freq>>1, (freq&0x01)<<7 | channels<<3}
+		if !bytes.Equal(asc, st.config) {
+			st.config = asc
+			d.onTag(codec.FLV_TAG_TYPE_AUDIO, dts, append([]byte{flvAudioAAC<<4 | 0x0F, 0}, asc...))
+		}
+		sampleRate := uint32(44100)
+		if int(freq) < len(aacSampleRates) {
+			sampleRate = aacSampleRates[freq]
+		}
+		// 一个 PES 可能包含多个 AAC 帧，每帧 1024 个采样
+		ts := dts + uint32(i)*1024*1000/sampleRate
+		d.onTag(codec.FLV_TAG_TYPE_AUDIO, ts, append([]byte{flvAudioAAC<<4 | 0x0F, 1}, data[headerLen:frameLen]...))
+		data = data[frameLen:]
+	}
+}
+
+// 判断格式: flv 头、TS 同步字节或 mp4 box
+func sniffMediaFormat(head []byte) (string, error) {
+	switch {
+	case len(head) >= 3 && head[0] == 'F' && head[1] == 'L' && head[2] == 'V':
+		return mediaFormatFLV, nil
+	case len(head) >= 1 && head[0] == tsSyncByte:
+		return mediaFormatTS, nil
+	case len(head) >= 8:
+		switch string(head[4:8]) {
+		case "ftyp", "styp", "moov", "moof":
+			return mediaFormatFMP4, nil
+		}
+	}
+	return "", errors.New("unknown media format")
+}
@@ -0,0 +1,119 @@
+package erwscascade
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+)
+
+func muxTS(tags []testTag) []byte {
+	m := &tsMuxer{}
+	var stream []byte
+	for _, tag := range tags {
+		stream = append(stream, m.writeTag(tag.t, tag.ts, tag.payload, true, true)...)
+	}
+	return stream
+}
+
+func demuxTS(t *testing.T, stream []byte) (video, audio []testTag) {
+	t.Helper()
+	var got []testTag
+	d := newTSDemuxer(func(t byte, ts uint32, payload []byte) {
+		got = append(got, testTag{t, ts, append([]byte{}, payload...)})
+	})
+	if err := d.read(bytes.NewReader(stream)); err != io.EOF {
+		t.Fatalf("read() error = %v", err)
+	}
+	return splitTags(got)
+}
+
+func TestTSRoundTrip(t *testing.T) {
+	video, audio := demuxTS(t, muxTS(testAVStream()))
+	// 第一个关键帧之前没有 PAT/PMT，之前的音频无法解析；视频 PES 不带长度，最后一帧等待下一个 PES
+	equalTags(t, "video", video, []testTag{
+		{codec.FLV_TAG_TYPE_VIDEO, 0, append([]byte{0x17, 0, 0, 0, 0}, testAVCC...)},
+		avcTag(0, true, 40, 0x65, 0x88),
+		avcTag(40, false, 0, 0x41, 0x9A),
+		avcTag(80, false, -40, 0x41, 0x9B),
+	})
+	equalTags(t, "audio", audio, []testTag{
+		{codec.FLV_TAG_TYPE_AUDIO, 23, append([]byte{0xAF, 0}, testASC...)},
+		aacTag(23, 0x21, 0x02),
+		aacTag(46, 0x21, 0x03),
+		aacTag(69, 0x21, 0x04),
+	})
+}
+
+// 丢失同步后需要连续 3 个间隔 188 字节的同步字节，负载中的 0x47 不会被当作包头
+func TestTSResync(t *testing.T) {
+	clean := muxTS(testAVStream())
+	wantVideo, wantAudio := demuxTS(t, clean)
+	// 已同步时只检查包头的同步字节，插入的数据以非同步字节开始
+	junk := []byte{0x02, tsSyncByte, 0x01, tsSyncByte, tsSyncByte}
+	insert := func(offsets ...int) []byte {
+		var out []byte
+		last := 0
+		for _, off := range offsets {
+			out = append(out, clean[last:off]...)
+			out = append(out, junk...)
+			last = off
+		}
+		return append(out, clean[last:]...)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{"junk before first packet", insert(0)},
+		{"junk between packets", insert(tsPacketSize * 5)},
+		// 插入位置间隔至少 3 个包，才能在两次插入之间重新同步
+		{"repeated junk", insert(0, tsPacketSize*3, tsPacketSize*7)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			video, audio := demuxTS(t, tt.stream)
+			equalTags(t, "video", video, wantVideo)
+			equalTags(t, "audio", audio, wantAudio)
+		})
+	}
+}
+
+func TestIsTSSynced(t *testing.T) {
+	packets := func(syncs ...int) []byte {
+		b := make([]byte, tsPacketSize*(tsSyncPackets-1)+1)
+		for _, i := range syncs {
+			b[i*tsPacketSize] = tsSyncByte
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"three sync bytes", packets(0, 1, 2), true},
+		{"missing +376", packets(0, 1), false},
+		{"missing +188", packets(0, 2), false},
+		{"single sync byte", packets(0), false},
+	}
+	for _, tt := range tests {
+		if got := isTSSynced(tt.head); got != tt.want {
+			t.Errorf("%s: isTSSynced() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTSTimestampWrap(t *testing.T) {
+	st := &tsStream{}
+	raws := []uint64{tsTimestampWrap - 90*40, tsTimestampWrap - 90*20, 0, 90 * 20}
+	var last uint32
+	for i, raw := range raws {
+		ms := st.millis(raw)
+		if i > 0 && ms-last != 20 {
+			t.Fatalf("millis(%d) = %d, step %d, want 20", raw, ms, ms-last)
+		}
+		last = ms
+	}
+}
@@ -2,12 +2,15 @@ package erwscascade
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"io"
 	"net"
+	"net/http"
+	neturl "net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
@@ -37,6 +40,23 @@ type WscPusher struct {
 	pool  util.BytesPool
 
 	connectCount int // 统计链接次数
+	backoff      *backoff
+	stopped      bool          // 上级平台要求停止推流，不再重连
+	stopCh       chan struct{} // 引擎结束推流时关闭，唤醒重连等待
+	stopOnce     sync.Once
+	enhanced     bool       // 上级平台确认支持 Enhanced FLV
+	withReply    bool       // 上级平台确认回复推流应答
+	legacyFrame  bool       // 老版本上级平台，使用老版本帧格式
+	format       string     // 媒体格式 flv、fmp4、ts，推流地址参数 format 指定
+	fmp4         *fmp4Muxer // fmp4 格式时的封装
+	ts           *tsMuxer   // ts 格式时的封装
+
+	queue  *sendQueue // 发送队列，为空时同步发送
+	ladder *ladder    // 主子码流自适应，推流地址参数 ladder 指定
+	stats  *sendStats
+
+	talk        *TalkPublisher // 上级平台回传的对讲音频
+	talkRetryAt time.Time      // 对讲流发布失败后，该时间之前不再尝试
 }
 
 func NewWscPusher(cc *ErWsCascadeConfig) *WscPusher {
@@ -46,6 +66,9 @@ func NewWscPusher(cc *ErWsCascadeConfig) *WscPusher {
 	pusher.Cc = cc
 	pusher.Status = 0
 	pusher.connectCount = 0
+	pusher.backoff = newBackoff(cc.Backoff)
+	pusher.stopCh = make(chan struct{})
+	pusher.stats = new(sendStats)
 	pusher.buf = util.Buffer(make([]byte, len(codec.FLVHeader)))
 	pusher.pool = make(util.BytesPool, 17)
 
@@ -72,6 +95,12 @@ func (pusher *WscPusher) Disconnect() {
 		return
 	}
 	pusher.Status = 0
+	pusher.stopLadder()
+	if pusher.queue != nil {
+		pusher.queue.close()
+		pusher.queue = nil
+	}
+	removeWscPusher(pusher)
 	//客户端主动断开webscocket 链接
 	if pusher.Conn != nil {
 		pusher.Info("WscPusher Disconnect to close ws connect")
@@ -91,27 +120,89 @@ func (pusher *WscPusher) Disconnect() {
 
 func (pusher *WscPusher) Connect() (err error) {
 
+	if pusher.stopped {
+		// 返回 io.EOF 通知引擎结束推流
+		return io.EOF
+	}
 	pusher.connectCount++
-	// 创建自定义的 TLS 配置
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+	if pusher.connectCount > 1 {
+		// 重连时指数退避，避免上级平台重启后大量推流同时重连
+		delay := pusher.backoff.Next()
+		pusher.Info("WscPusher reconnect wait", zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-pusher.stopCh:
+			timer.Stop()
+			return io.EOF
+		}
+		// 等待期间上级平台可能已要求停止
+		if pusher.stopped {
+			return io.EOF
+		}
+	}
+	// 按推流地址匹配上级平台的 TLS 配置
+	tlsConfig, err := pusher.Cc.tlsConfigFor(pusher.RemoteURL)
+	if err != nil {
+		pusher.Error("WscPusher tls config faild", zap.Error(err))
+		return err
 	}
 
-	// 创建 Dialer
-	dialer := ws.Dialer{
-		TLSConfig: tlsConfig,
+	//推流地址中没有流名称时使用本地流名称，并补充 cid 参数
+	url, err := buildWspushURL(pusher.RemoteURL, pusher.StreamPath, pusher.Cc.CInfo.Cid)
+	if err != nil {
+		pusher.Error("WscPusher invalid remoteURL", zap.Error(err))
+		return err
+	}
+	u, err := neturl.Parse(url)
+	if err != nil {
+		pusher.Error("WscPusher invalid remoteURL", zap.Error(err))
+		return err
+	}
+
+	// 按推流地址匹配上级平台的注册鉴权密钥，握手时使用与注册相同的签名头
+	var secret string
+	if s, _ := pusher.Cc.serverConfigFor(pusher.RemoteURL); s != nil {
+		secret = s.Secret
 	}
 
-	url := ""
-	if !strings.Contains(pusher.RemoteURL, "?cid=") {
-		url = pusher.RemoteURL + "?cid=" + pusher.Cc.CInfo.Cid
-	} else {
-		url = pusher.RemoteURL
+	// 创建 Dialer，握手时协商 Enhanced FLV，上级平台未确认时使用传统 FLV；
+	// 声明可接收推流应答，上级平台未确认时(老版本)不等待应答；
+	// 声明发送标准 ws 帧，erwscascade 上级平台未确认时(老版本)使用老版本帧格式
+	pusher.enhanced, pusher.withReply = false, false
+	standardFrame := false
+	header := registerAuthHeader(secret, u.Query().Get("cid"))
+	header.Set(HeaderPushReply, pushReplyJSON)
+	header.Set(HeaderWsFrame, wsFrameStandard)
+	if pusher.Cc.EnhancedFlv {
+		header.Set(HeaderFlvFormat, flvFormatEnhanced)
+	}
+	dialer := ws.Dialer{
+		TLSConfig: tlsConfig,
+		Header:    ws.HandshakeHeaderHTTP(header),
+		OnHeader: func(key, value []byte) error {
+			switch {
+			case strings.EqualFold(string(key), HeaderFlvFormat):
+				pusher.enhanced = pusher.Cc.EnhancedFlv && string(value) == flvFormatEnhanced
+			case strings.EqualFold(string(key), HeaderPushReply):
+				pusher.withReply = string(value) == pushReplyJSON
+			case strings.EqualFold(string(key), HeaderWsFrame):
+				standardFrame = string(value) == wsFrameStandard
+			}
+			return nil
+		},
 	}
 
 	//url := pusher.RemoteURL + "?cid=" + pusher.Cc.CInfo.Cid
 	//url += "&streamPath=" + pusher.StreamPath
 
+	pusher.format = parseMediaFormat(u.Query())
+	if pusher.format == "" {
+		pusher.format = mediaFormatFLV
+	}
+	pusher.fmp4 = &fmp4Muxer{}
+	pusher.ts = &tsMuxer{}
+
 	pusher.Info("WscPusher try connect times:"+strconv.Itoa(pusher.connectCount), zap.String("remoteURL", url))
 
 	conn, _, _, err := dialer.Dial(context.Background(), url)
@@ -119,6 +210,22 @@ func (pusher *WscPusher) Connect() (err error) {
 		pusher.Error("WscPusher connect faild", zap.Error(err))
 		return err
 	}
+	pusher.legacyFrame = !standardFrame && isCascadeWspush(url)
+	pusher.Info("WscPusher connected", zap.String("format", pusher.format), zap.Bool("enhanced", pusher.enhanced), zap.Bool("legacyFrame", pusher.legacyFrame))
+	//上级平台在媒体数据之前回复是否接受推流
+	if pusher.withReply {
+		reply, err := pusher.readReply(conn)
+		if err != nil {
+			pusher.Error("WscPusher read reply faild", zap.Error(err))
+			conn.Close()
+			return err
+		}
+		if !reply.Accept {
+			conn.Close()
+			return pusher.onReject(reply)
+		}
+		pusher.Info("WscPusher accepted", zap.String("streamPath", reply.StreamPath), zap.Bool("resume", reply.Resume), zap.String("policy", reply.Policy))
+	}
 	//
 	pusher.SetParentCtx(context.Background()) //注入context
 	pusher.RemoteAddr = url
@@ -127,14 +234,26 @@ func (pusher *WscPusher) Connect() (err error) {
 
 	pusher.Conn = &conn
 	pusher.Status = 1
+	pusher.backoff.Reset()
 
 	//发送FlvHeader
 	pusher.WriteFlvHeader()
 
+	//之后的音视频经发送队列异步发送
+	if pusher.Cc.SendQueue > 0 {
+		pusher.queue = newSendQueue(pusher.Cc.SendQueue, pusher.stats)
+		go pusher.sendLoop(pusher.queue)
+	}
+	addWscPusher(pusher)
+
 	return nil
 }
 
 func (sub *WscPusher) WriteFlvHeader() {
+	if sub.format != mediaFormatFLV {
+		// fmp4 收到解码配置后发送 init segment，ts 关键帧前发送 PAT/PMT
+		return
+	}
 	at, vt := sub.Audio, sub.Video
 	hasAudio, hasVideo := at != nil, vt != nil
 	var amf util.AMF
@@ -155,6 +274,9 @@ func (sub *WscPusher) WriteFlvHeader() {
 	if hasAudio {
 		flags |= (1 << 2)
 		metaData["audiocodecid"] = int(at.CodecID)
+		if sub.enhanced && int(at.CodecID) == legacyAudioOpus {
+			metaData["audiocodecid"] = int(fourCCValue(fourCCOpus))
+		}
 		metaData["audiosamplerate"] = at.SampleRate
 		metaData["audiosamplesize"] = at.SampleSize
 		metaData["stereo"] = at.Channels == 2
@@ -162,6 +284,14 @@ func (sub *WscPusher) WriteFlvHeader() {
 	if hasVideo {
 		flags |= 1
 		metaData["videocodecid"] = int(vt.CodecID)
+		if sub.enhanced {
+			switch int(vt.CodecID) {
+			case legacyVideoH265:
+				metaData["videocodecid"] = int(fourCCValue(fourCCHEVC))
+			case legacyVideoAV1:
+				metaData["videocodecid"] = int(fourCCValue(fourCCAV1))
+			}
+		}
 		metaData["width"] = vt.SPSInfo.Width
 		metaData["height"] = vt.SPSInfo.Height
 	}
@@ -188,27 +318,30 @@ func (pusher *WscPusher) PlayFlv() {
 	go pusher.Subscriber.PlayFLV()
 }
 
-// 预留双向通信
+// 读取上级平台回传的 flv tag，音频作为对讲流发布
 func (pusher *WscPusher) ReadFLVTag() {
 	var startTs uint32
 	offsetTs := pusher.absTS
 	for {
-		//读取掩码头部信息
-		_, err := ws.ReadHeader(*pusher.Conn)
-		if err != nil {
-			// 处理读取头部信息错误
-			pusher.OnConnErr(zap.Error(err))
+		conn := pusher.Conn
+		if conn == nil {
 			break
 		}
-
-		//log.Println(header)
-		//{"error": "frames from client to server must be masked"}
-		data, err := wsutil.ReadServerBinary(*pusher.Conn)
+		data, op, err := wsutil.ReadServerData(*conn)
 		if err != nil {
-			//延迟10秒
+			if closed, ok := isStopNotice(err); ok {
+				// 上级平台无人观看或被其他推流顶替，结束推流
+				pusher.Info("WscPusher stop by server", zap.Int("code", int(closed.Code)), zap.String("reason", closed.Reason))
+				pusher.stopped = true
+				pusher.Disconnect()
+				break
+			}
 			pusher.OnConnErr(zap.Error(err))
 			break
 		}
+		if op != ws.OpBinary {
+			continue
+		}
 
 		// 解码数据
 		// mask := header.Mask
@@ -218,6 +351,7 @@ func (pusher *WscPusher) ReadFLVTag() {
 		t, timestamp, payload, err := pusher.ParseFLVTag(data)
 		if err != nil {
 			pusher.OnConnErr(zap.Error(err))
+			break
 		}
 		if startTs == 0 {
 			startTs = timestamp
@@ -233,7 +367,10 @@ func (pusher *WscPusher) ReadFLVTag() {
 		//log.Printf("type:%v, absTS:%v timestamp:%v\n", t, recever.absTS, timestamp)
 		switch t {
 		case codec.FLV_TAG_TYPE_AUDIO:
-			//recever.WriteAVCCAudio(recever.absTS, &frame, recever.pool)
+			// 对讲音频发布为本地流 streamPath/talk
+			if talk := pusher.talkPublisher(); talk != nil {
+				talk.WriteAVCCAudio(pusher.absTS, &frame, pusher.pool)
+			}
 		case codec.FLV_TAG_TYPE_VIDEO:
 			//recever.WriteAVCCVideo(recever.absTS, &frame, recever.pool)
 		case codec.FLV_TAG_TYPE_SCRIPT:
@@ -242,11 +379,23 @@ func (pusher *WscPusher) ReadFLVTag() {
 		}
 	}
 
+	pusher.stopTalk()
 	pusher.Info("WscPusher ReadFLVTag end...")
 }
 
 func (pusher *WscPusher) Push() (err error) {
 	pusher.Info("WscPusher try PlayFlv push...")
+	// 先订阅码率阶梯的其他档位，保证缓存到第 0 档的解码配置
+	if u, err := neturl.Parse(pusher.RemoteURL); err == nil {
+		if paths := parseLadder(pusher.StreamPath, u.Query().Get("ladder")); paths != nil {
+			// 拥塞判断依赖发送队列，同步发送时无法降档
+			if pusher.Cc.SendQueue > 0 {
+				pusher.startLadder(paths)
+			} else {
+				pusher.Error("WscPusher ladder requires sendqueue > 0, ignored", zap.Strings("levels", paths))
+			}
+		}
+	}
 	pusher.PlayFlv()
 
 	//这个循环对应Push 接口很重要否则会进入不断重连
@@ -275,6 +424,12 @@ func (pusher *WscPusher) Push() (err error) {
 	return nil
 }
 
+// 引擎结束推流，正在等待重连时立即返回
+func (pusher *WscPusher) Stop(reason ...zapcore.Field) {
+	pusher.stopOnce.Do(func() { close(pusher.stopCh) })
+	pusher.Subscriber.Stop(reason...)
+}
+
 func (pusher *WscPusher) IsClosed() bool {
 	return pusher.Status != 1
 }
@@ -300,6 +455,9 @@ func (pusher *WscPusher) ParseFLVTag(b []byte) (t byte, timestamp uint32, payloa
 	timestamp |= uint32(b[7]) << 24                               // 扩展时间戳
 	//streamID := uint32(b[8])<<16 | uint32(b[9])<<8 | uint32(b[10]) // 流ID  默认为0
 
+	if int(11+dataSize) > len(b) {
+		return 0, 0, nil, errors.New("FLV Tag data size overflow")
+	}
 	payload = b[11 : 11+dataSize] // 数据payload
 
 	//log.Printf("dataSize:%v ,buf len:%v", dataSize+1, len(b))
@@ -314,8 +472,11 @@ func (pusher *WscPusher) WriteFLVTag(tag FLVFrame) {
 		return
 	}
 
-	// 掩码密钥
-	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	// 码率阶梯第 0 档
+	if pusher.ladder != nil {
+		pusher.writeLadderTag(0, tag)
+		return
+	}
 
 	// 将FLVFrame转换为net.Buffers类型
 	buffers := net.Buffers(tag)
@@ -324,40 +485,114 @@ func (pusher *WscPusher) WriteFLVTag(tag FLVFrame) {
 	for _, buf := range buffers {
 		data = append(data, buf...)
 	}
+	pusher.writeTag(data)
+}
 
-	//for debug
-	// t, timestamp, _, err := pusher.ParseFLVTag(data)
-	// if err != nil {
-	// 	pusher.OnConnErr(zap.Error(err))
-	// } else {
-	// 	//log.Println("type:", t)
-	// 	//log.Println("timestamp:", timestamp)
-	// 	//log.Println("payload:", payload)
-	// }
+// 按媒体格式封装一个 flv tag 并发送
+func (pusher *WscPusher) writeTag(data []byte) {
+	t, timestamp, payload, err := pusher.ParseFLVTag(data)
+	if err != nil {
+		pusher.OnConnErr(zap.Error(err))
+		return
+	}
+	item := &sendItem{kind: tagKind(t, payload)}
 
-	// 对FLV数据集进行掩码处理
-	// maskedFLVData := make([]byte, len(data))
-	// for i, b := range data {
-	// 	maskedFLVData[i] = b ^ mask[i%4]
-	// }
+	switch pusher.format {
+	case mediaFormatFMP4:
+		// fmp4 输出的是上一帧的 segment
+		if vt := pusher.Video; vt != nil {
+			pusher.fmp4.width, pusher.fmp4.height = uint16(vt.SPSInfo.Width), uint16(vt.SPSInfo.Height)
+		}
+		item.data, item.kind = pusher.fmp4.writeTag(t, timestamp, payload, pusher.Video != nil, pusher.Audio != nil)
+	case mediaFormatTS:
+		// 每帧的 TS 包作为一个 ws 消息发送
+		if packets := pusher.ts.writeTag(t, timestamp, payload, pusher.Video != nil, pusher.Audio != nil); len(packets) > 0 {
+			item.data = [][]byte{packets}
+		}
+	default:
+		//HEVC/AV1/Opus 按 Enhanced FLV 发送
+		if pusher.enhanced {
+			data = enhanceFLVTag(data)
+		}
+		item.data = [][]byte{data}
+	}
+	if len(item.data) == 0 {
+		return
+	}
 
-	//{"error": "frames from client to server must be masked"}
-	//需要注意，websocket 客户端主动向服务器发送二进制消息需要添加掩码，否则服务器接收数据会提示错误：frames from client to server must be masked
-	//发送ws.Header 掩码信息后，我局域网测试可以骗过服务器，实际上没有对flv 进行掩码，如果测试不行则打开前面注释，对数据进行掩码处理
-	//
-	if err := ws.WriteHeader(pusher, ws.Header{
-		Fin:    true,
-		OpCode: ws.OpBinary,
-		Masked: true,
-		Mask:   mask, //[4]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))},
-		Length: int64(len(data)),
-	}); err != nil {
-		pusher.OnConnErr(zap.Error(err))
+	if queue := pusher.queue; queue != nil {
+		if dropping, changed := queue.push(item); changed {
+			if dropping {
+				pusher.Warn("WscPusher send queue full, drop video until keyframe", zap.Int("size", pusher.Cc.SendQueue))
+			} else {
+				pusher.Info("WscPusher send queue recovered", zap.Uint64("droppedVideo", atomic.LoadUint64(&pusher.stats.droppedVideo)))
+			}
+		}
 		return
 	}
+	pusher.writeItem(item)
+}
 
-	if err := wsutil.WriteClientBinary(pusher, data); err != nil {
-		pusher.OnConnErr(zap.Error(err))
+// 按 flv tag 判断发送队列中的帧类型
+func tagKind(t byte, payload []byte) itemKind {
+	if isSequenceTag(t, payload) || len(payload) < 2 {
+		return itemConfig
+	}
+	switch {
+	case t == codec.FLV_TAG_TYPE_AUDIO:
+		return itemAudio
+	case t != codec.FLV_TAG_TYPE_VIDEO:
+		return itemConfig
+	case (payload[0]>>4)&0x07 == 1:
+		return itemKeyframe
+	}
+	return itemVideo
+}
+
+// 是否为音视频解码配置
+func isSequenceTag(t byte, payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch t {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		if payload[0]&0x80 != 0 {
+			return payload[0]&0x0F == videoPacketSequenceStart
+		}
+		return payload[1] == 0
+	case codec.FLV_TAG_TYPE_AUDIO:
+		return payload[0]>>4 == flvAudioAAC && payload[1] == 0
+	}
+	return false
+}
+
+// 标准 RFC 6455 客户端帧: 单个二进制帧，随机掩码并对内容做掩码处理；
+// 老版本上级平台在每个帧前多写一个固定掩码的空帧头
+func (pusher *WscPusher) writeItem(item *sendItem) bool {
+	for _, data := range item.data {
+		var err error
+		if pusher.legacyFrame {
+			err = writeLegacyFrame(pusher, data)
+		} else {
+			err = wsutil.WriteClientBinary(pusher, data)
+		}
+		if err != nil {
+			pusher.OnConnErr(zap.Error(err))
+			return false
+		}
+		atomic.AddUint64(&pusher.stats.sentBytes, uint64(len(data)))
+	}
+	atomic.AddUint64(&pusher.stats.sentFrames, 1)
+	return true
+}
+
+// 发送队列写协程
+func (pusher *WscPusher) sendLoop(queue *sendQueue) {
+	for {
+		item, ok := queue.pop()
+		if !ok || !pusher.writeItem(item) {
+			return
+		}
 	}
 }
 
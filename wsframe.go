@@ -0,0 +1,173 @@
+package erwscascade
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+/**
+	上级平台读取下级平台推送的标准 ws 帧(RFC 6455), 把二进制帧内容作为连续的字节流,
+	不依赖一帧一个 flv tag, 可接收任意标准 ws-flv 客户端推流
+**/
+
+// 老版本 WscPusher 在每个 flv tag 前多写一个固定掩码的帧头(无内容)
+var legacyMask = [4]byte{0x12, 0x34, 0x56, 0x78}
+
+// 推流端握手时声明发送标准 ws 帧，新版本上级平台在应答中确认；
+// 老版本上级平台按一个帧头加一个 tag 读取，未确认时推流端使用老版本帧格式
+const (
+	HeaderWsFrame   = "X-Erwscascade-Frame"
+	wsFrameStandard = "rfc6455"
+)
+
+// 老版本帧格式: 固定掩码的空帧头之后是标准二进制帧
+func writeLegacyFrame(w io.Writer, data []byte) error {
+	header := ws.Header{Fin: true, OpCode: ws.OpBinary, Masked: true, Mask: legacyMask, Length: int64(len(data))}
+	if err := ws.WriteHeader(w, header); err != nil {
+		return err
+	}
+	return wsutil.WriteClientBinary(w, data)
+}
+
+// 单个 ws 消息最大长度
+const maxWsMessageSize = 16 * 1024 * 1024
+
+type wsStreamReader struct {
+	conn      net.Conn
+	writeLock *sync.Mutex // 回复 pong、close 时与其他写操作互斥
+	buf       []byte      // 当前二进制消息未读完的部分
+}
+
+func newWsStreamReader(conn net.Conn, writeLock *sync.Mutex) *wsStreamReader {
+	return &wsStreamReader{
+		conn:      conn,
+		writeLock: writeLock,
+	}
+}
+
+func (r *wsStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		data, err := r.nextMessage()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// 预读至少 n 字节，不消耗数据
+func (r *wsStreamReader) peek(n int) ([]byte, error) {
+	for len(r.buf) < n {
+		data, err := r.nextMessage()
+		if err != nil {
+			return nil, err
+		}
+		r.buf = append(r.buf, data...)
+	}
+	return r.buf[:n], nil
+}
+
+func (r *wsStreamReader) writeFrame(f ws.Frame) error {
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	return ws.WriteFrame(r.conn, f)
+}
+
+// 读取下一个完整的二进制消息，处理分片与控制帧，忽略文本消息
+func (r *wsStreamReader) nextMessage() ([]byte, error) {
+	var message []byte
+	var op ws.OpCode
+	for {
+		h, err := ws.ReadHeader(r.conn)
+		if err != nil {
+			return nil, err
+		}
+		if h.OpCode == ws.OpBinary && h.Masked && h.Mask == legacyMask && h.Fin {
+			// 老版本 WscPusher 的多余帧头，真正的帧紧随其后
+			continue
+		}
+		if h.Length > maxWsMessageSize || int64(len(message))+h.Length > maxWsMessageSize {
+			return nil, errors.New("ws message too large")
+		}
+		payload := make([]byte, h.Length)
+		if _, err = io.ReadFull(r.conn, payload); err != nil {
+			return nil, err
+		}
+		if h.Masked {
+			ws.Cipher(payload, h.Mask, 0)
+		}
+
+		if h.OpCode.IsControl() {
+			switch h.OpCode {
+			case ws.OpClose:
+				r.writeFrame(ws.NewCloseFrame(payload))
+				return nil, io.EOF
+			case ws.OpPing:
+				if err = r.writeFrame(ws.NewPongFrame(payload)); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if h.OpCode != ws.OpContinuation {
+			op = h.OpCode
+			message = message[:0]
+		}
+		message = append(message, payload...)
+		if !h.Fin {
+			continue
+		}
+		if op == ws.OpBinary {
+			return message, nil
+		}
+		message = nil
+	}
+}
+
+// 从字节流读取 flv 头，返回 flv 头中的音视频标志
+func readFLVHeader(r io.Reader) (flags byte, err error) {
+	var head [9]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[0] != 'F' || head[1] != 'L' || head[2] != 'V' {
+		return 0, errors.New("invalid flv head")
+	}
+	// 跳过扩展头部与 PreviousTagSize0
+	offset := uint32(head[5])<<24 | uint32(head[6])<<16 | uint32(head[7])<<8 | uint32(head[8])
+	if offset < 9 {
+		return 0, errors.New("invalid flv head offset")
+	}
+	if _, err = io.CopyN(io.Discard, r, int64(offset-9)+4); err != nil {
+		return
+	}
+	return head[4], nil
+}
+
+// 从字节流读取一个 flv tag(包括其后的 PreviousTagSize)
+func readFLVTag(r io.Reader) (t byte, timestamp uint32, payload []byte, err error) {
+	var head [11]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	t = head[0]                                                            // Tag类型
+	dataSize := uint32(head[1])<<16 | uint32(head[2])<<8 | uint32(head[3]) // 数据部分大小
+	timestamp = uint32(head[4])<<16 | uint32(head[5])<<8 | uint32(head[6]) // 时间戳
+	timestamp |= uint32(head[7]) << 24                                     // 扩展时间戳
+	payload = make([]byte, dataSize)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	var previousTagSize [4]byte
+	_, err = io.ReadFull(r, previousTagSize[:])
+	return
+}
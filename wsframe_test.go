@@ -0,0 +1,136 @@
+package erwscascade
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// 从缓冲区读取、写入另一个缓冲区的连接
+type bufConn struct {
+	net.Conn
+	r   io.Reader
+	out bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func clientFrame(op ws.OpCode, fin bool, payload []byte) []byte {
+	var b bytes.Buffer
+	ws.WriteFrame(&b, ws.MaskFrame(ws.NewFrame(op, fin, payload)))
+	return b.Bytes()
+}
+
+func frameHeader(h ws.Header) []byte {
+	var b bytes.Buffer
+	ws.WriteHeader(&b, h)
+	return b.Bytes()
+}
+
+func legacyFrame(payload []byte) []byte {
+	var b bytes.Buffer
+	writeLegacyFrame(&b, payload)
+	return b.Bytes()
+}
+
+func TestWsStreamReaderNextMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		want    [][]byte
+		wantErr bool
+		reply   ws.OpCode // 需要回复的控制帧
+	}{
+		{"single frame", [][]byte{clientFrame(ws.OpBinary, true, []byte("abc"))},
+			[][]byte{[]byte("abc")}, false, 0},
+		{"fragmented", [][]byte{
+			clientFrame(ws.OpBinary, false, []byte("ab")),
+			clientFrame(ws.OpContinuation, false, []byte("cd")),
+			clientFrame(ws.OpContinuation, true, []byte("ef")),
+		}, [][]byte{[]byte("abcdef")}, false, 0},
+		{"ping between fragments", [][]byte{
+			clientFrame(ws.OpBinary, false, []byte("ab")),
+			clientFrame(ws.OpPing, true, []byte("p")),
+			clientFrame(ws.OpContinuation, true, []byte("cd")),
+		}, [][]byte{[]byte("abcd")}, false, ws.OpPong},
+		{"skip text", [][]byte{
+			clientFrame(ws.OpText, true, []byte("{}")),
+			clientFrame(ws.OpBinary, true, []byte("abc")),
+		}, [][]byte{[]byte("abc")}, false, 0},
+		{"legacy header", [][]byte{legacyFrame([]byte("tag1")), legacyFrame([]byte("tag2"))},
+			[][]byte{[]byte("tag1"), []byte("tag2")}, false, 0},
+		{"unmasked", [][]byte{frameHeader(ws.Header{Fin: true, OpCode: ws.OpBinary, Length: 3}), []byte("xyz")},
+			[][]byte{[]byte("xyz")}, false, 0},
+		{"frame too large", [][]byte{
+			frameHeader(ws.Header{Fin: true, OpCode: ws.OpBinary, Length: maxWsMessageSize + 1}),
+		}, nil, true, 0},
+		{"fragments too large", [][]byte{
+			clientFrame(ws.OpBinary, false, []byte("ab")),
+			frameHeader(ws.Header{Fin: true, OpCode: ws.OpContinuation, Length: maxWsMessageSize - 1}),
+		}, nil, true, 0},
+		{"close", [][]byte{clientFrame(ws.OpClose, true, ws.NewCloseFrameBody(ws.StatusNormalClosure, ""))},
+			nil, true, ws.OpClose},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &bufConn{r: bytes.NewReader(bytes.Join(tt.frames, nil))}
+			r := newWsStreamReader(conn, &sync.Mutex{})
+			for i, want := range tt.want {
+				got, err := r.nextMessage()
+				if err != nil {
+					t.Fatalf("nextMessage() #%d error = %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("nextMessage() #%d = %q, want %q", i, got, want)
+				}
+			}
+			if tt.wantErr {
+				if _, err := r.nextMessage(); err == nil {
+					t.Fatal("nextMessage() error = nil, want error")
+				}
+			}
+			if tt.reply != 0 {
+				h, err := ws.ReadHeader(&conn.out)
+				if err != nil || h.OpCode != tt.reply || h.Masked {
+					t.Fatalf("reply header = %+v, %v, want unmasked %v", h, err, tt.reply)
+				}
+			}
+		})
+	}
+}
+
+// flv tag 可以跨越多个 ws 消息
+func TestWsStreamReaderFLVStream(t *testing.T) {
+	tag := []byte{0x09, 0, 0, 3, 0, 0, 0x28, 0, 0, 0, 0, 0x17, 1, 0, 0, 0, 0, 14}
+	var frames bytes.Buffer
+	wsutil.WriteClientBinary(&frames, []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0})
+	wsutil.WriteClientBinary(&frames, tag[:5])
+	frames.Write(legacyFrame(tag[5:12]))
+	wsutil.WriteClientBinary(&frames, tag[12:])
+
+	r := newWsStreamReader(&bufConn{r: &frames}, &sync.Mutex{})
+	head, err := r.peek(3)
+	if err != nil || string(head) != "FLV" {
+		t.Fatalf("peek() = %q, %v", head, err)
+	}
+	flags, err := readFLVHeader(r)
+	if err != nil || flags != 0x05 {
+		t.Fatalf("readFLVHeader() = %#x, %v", flags, err)
+	}
+	typ, timestamp, payload, err := readFLVTag(r)
+	if err != nil {
+		t.Fatalf("readFLVTag() error = %v", err)
+	}
+	if typ != 0x09 || timestamp != 40 || !bytes.Equal(payload, []byte{0x17, 1, 0}) {
+		t.Fatalf("readFLVTag() = %#x, %d, %x", typ, timestamp, payload)
+	}
+	if _, _, _, err = readFLVTag(r); err != io.EOF && err != io.ErrUnexpectedEOF {
+		t.Fatalf("readFLVTag() at end = %v, want EOF", err)
+	}
+}
@@ -0,0 +1,89 @@
+package erwscascade
+
+import (
+	"net/url"
+	"strings"
+)
+
+/**
+	wspush 推流地址: ws://host[/conextpath]/erwscascade/wspush/{streamPath...}?cid=xx[&streamPath=xx]
+	wspush 之后的全部路径(url 解码)为流名称, 查询参数 streamPath 优先
+**/
+
+const wspushSegment = "/wspush/"
+
+// 解析 wspush 之后的流名称
+func parseWspushStreamPath(u *url.URL) (string, error) {
+	if v := u.Query().Get("streamPath"); v != "" {
+		return strings.Trim(v, "/"), nil
+	}
+	escaped := u.EscapedPath()
+	idx := strings.Index(escaped, wspushSegment)
+	if idx < 0 {
+		return "", nil
+	}
+	streamPath, err := url.PathUnescape(escaped[idx+len(wspushSegment):])
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(streamPath, "/"), nil
+}
+
+// 按段转义流名称，保留分隔符 /
+func escapeStreamPath(streamPath string) string {
+	parts := strings.Split(streamPath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// 生成推流地址: 地址中没有流名称(以 wspush/ 结尾或为 wspush/on)时使用本地流名称，并补充 cid 参数
+func buildWspushURL(remoteURL string, streamPath string, cid string) (string, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	escaped := u.EscapedPath()
+	if idx := strings.Index(escaped+"/", wspushSegment); idx >= 0 && query.Get("streamPath") == "" {
+		rest := strings.Trim(escaped[idx+len("/wspush"):], "/")
+		if rest == "" {
+			u.RawPath = strings.TrimRight(escaped, "/") + "/" + escapeStreamPath(streamPath)
+			u.Path, _ = url.PathUnescape(u.RawPath)
+		} else if rest == "on" {
+			query.Set("streamPath", streamPath)
+		}
+	}
+	if query.Get("cid") == "" {
+		query.Set("cid", cid)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// 级联媒体格式，推流地址参数 format 指定
+const (
+	mediaFormatFLV  = "flv"
+	mediaFormatFMP4 = "fmp4"
+	mediaFormatTS   = "ts"
+)
+
+// 推流地址中的媒体格式，未指定时返回空
+func parseMediaFormat(query url.Values) string {
+	switch format := strings.ToLower(query.Get("format")); format {
+	case mediaFormatFLV, mediaFormatFMP4, mediaFormatTS:
+		return format
+	default:
+		return ""
+	}
+}
+
+// 推流地址是否为 erwscascade 上级平台的 wspush 接口(第三方 ws-flv 接收端使用标准帧)
+func isCascadeWspush(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(u.Path, "/erwscascade"+wspushSegment)
+}
@@ -0,0 +1,117 @@
+package erwscascade
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseWspushStreamPath(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   string
+	}{
+		{"/erwscascade/wspush/njtv/glgc", "njtv/glgc"},
+		{"/erwscascade/wspush/njtv/glgc/", "njtv/glgc"},
+		{"/ctx/erwscascade/wspush/njtv/cam%201", "njtv/cam 1"},
+		{"/erwscascade/wspush/njtv%2Fa/b", "njtv/a/b"},
+		{"/erwscascade/wspush/njtv/glgc?streamPath=/live/test/", "live/test"},
+		{"/erwscascade/wspush/", ""},
+		{"/erwscascade/other/njtv/glgc", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawURL, func(t *testing.T) {
+			u, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseWspushStreamPath(u)
+			if err != nil {
+				t.Fatalf("parseWspushStreamPath() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseWspushStreamPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildWspushURL(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteURL  string
+		streamPath string
+		want       string
+		parsed     string // 上级平台从推流地址解析出的流名称
+	}{
+		{"append stream", "ws://127.0.0.1:8450/erwscascade/wspush/", "njtv/glgc",
+			"ws://127.0.0.1:8450/erwscascade/wspush/njtv/glgc?cid=c001", "njtv/glgc"},
+		{"without trailing slash", "wss://host/ctx/erwscascade/wspush", "njtv/glgc",
+			"wss://host/ctx/erwscascade/wspush/njtv/glgc?cid=c001", "njtv/glgc"},
+		{"escape stream", "ws://host/erwscascade/wspush/", "njtv/cam 1",
+			"ws://host/erwscascade/wspush/njtv/cam%201?cid=c001", "njtv/cam 1"},
+		{"legacy on", "ws://host/erwscascade/wspush/on?format=ts", "njtv/glgc",
+			"ws://host/erwscascade/wspush/on?cid=c001&format=ts&streamPath=njtv%2Fglgc", "njtv/glgc"},
+		{"keep stream and cid", "ws://host/erwscascade/wspush/live/other?cid=c009", "njtv/glgc",
+			"ws://host/erwscascade/wspush/live/other?cid=c009", "live/other"},
+		{"keep query streamPath", "ws://host/erwscascade/wspush/?streamPath=live/other", "njtv/glgc",
+			"ws://host/erwscascade/wspush/?cid=c001&streamPath=live%2Fother", "live/other"},
+		{"third party", "ws://srs:8080/live/test.flv", "njtv/glgc",
+			"ws://srs:8080/live/test.flv?cid=c001", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildWspushURL(tt.remoteURL, tt.streamPath, "c001")
+			if err != nil {
+				t.Fatalf("buildWspushURL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("buildWspushURL() = %q, want %q", got, tt.want)
+			}
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sp, _ := parseWspushStreamPath(u); sp != tt.parsed {
+				t.Fatalf("parseWspushStreamPath(%q) = %q, want %q", got, sp, tt.parsed)
+			}
+		})
+	}
+}
+
+func TestParseMediaFormat(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", ""},
+		{"format=flv", mediaFormatFLV},
+		{"format=FMP4", mediaFormatFMP4},
+		{"format=ts", mediaFormatTS},
+		{"format=hls", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			if got := parseMediaFormat(query); got != tt.want {
+				t.Fatalf("parseMediaFormat(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCascadeWspush(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   bool
+	}{
+		{"ws://host:8450/erwscascade/wspush/njtv/glgc?cid=c001", true},
+		{"wss://host/ctx/erwscascade/wspush/on", true},
+		{"ws://srs:8080/live/test.flv", false},
+		{"ws://host/wspush/njtv/glgc", false},
+	}
+	for _, tt := range tests {
+		if got := isCascadeWspush(tt.rawURL); got != tt.want {
+			t.Errorf("isCascadeWspush(%q) = %v, want %v", tt.rawURL, got, tt.want)
+		}
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	. "m7s.live/engine/v4"
@@ -32,17 +34,38 @@ type WssRecever struct {
 	buf    util.Buffer
 	pool   util.BytesPool
 
-	Cc *ErWsCascadeConfig
+	lastWrite   int64         // 最近发布数据的时间(UnixNano，原子读写)，重连接续时按断线时长平移时间戳
+	subscribers int32         // 订阅者数量，在引擎通知的事件中更新
+	done        chan struct{} // 读取结束
+
+	Cc        *ErWsCascadeConfig
+	writeLock sync.Mutex // 向下级平台回写 ws 消息
+	reader    *wsStreamReader
+
+	firstTag *flvTag // 推流端未发送 script tag 时，读取 flv 头后的第一个 tag
+	format   string  // 媒体格式 flv、fmp4、ts
+
+	talkLock sync.Mutex
+	talk     *TalkSubscriber // 对讲，回传音频给下级平台
+}
+
+type flvTag struct {
+	t         byte
+	timestamp uint32
+	payload   []byte
 }
 
 func NewWssRecever(cc *ErWsCascadeConfig, cid string, conn *net.Conn) *WssRecever {
-	return &WssRecever{
+	recever := &WssRecever{
 		Cc:   cc,
 		Cid:  cid,
 		Conn: conn,
 		buf:  util.Buffer(make([]byte, len(codec.FLVHeader))),
 		pool: make(util.BytesPool, 17),
+		done: make(chan struct{}),
 	}
+	recever.reader = newWsStreamReader(*conn, &recever.writeLock)
+	return recever
 }
 
 // 统一处理读写错误
@@ -65,6 +88,9 @@ func (recever *WssRecever) ParseFLVTag(b []byte) (t byte, timestamp uint32, payl
 	timestamp |= uint32(b[7]) << 24                               // 扩展时间戳
 	//streamID := uint32(b[8])<<16 | uint32(b[9])<<8 | uint32(b[10]) // 流ID
 
+	if int(11+dataSize) > len(b) {
+		return 0, 0, nil, errors.New("FLV Tag data size overflow")
+	}
 	payload = b[11 : 11+dataSize] // 数据payload
 
 	//log.Printf("dataSize:%v ,buf len:%v", dataSize+1, len(b))
@@ -72,64 +98,109 @@ func (recever *WssRecever) ParseFLVTag(b []byte) (t byte, timestamp uint32, payl
 	return t, timestamp, payload, nil
 }
 
+// 读取下一个 flv tag
+func (recever *WssRecever) nextFLVTag() (t byte, timestamp uint32, payload []byte, err error) {
+	if tag := recever.firstTag; tag != nil {
+		recever.firstTag = nil
+		return tag.t, tag.timestamp, tag.payload, nil
+	}
+	return readFLVTag(recever.reader)
+}
+
 func (recever *WssRecever) ReadFLVTag() {
 	var startTs uint32
+	started := false
 	offsetTs := recever.absTS
 	for {
-		//读取掩码头部信息
-		_, err := ws.ReadHeader(*recever.Conn)
+		//标准 ws 帧中的 flv 字节流，不要求一帧一个 tag
+		t, timestamp, payload, err := recever.nextFLVTag()
 		if err != nil {
-			// 处理读取头部信息错误
 			recever.OnConnErr(zap.Error(err))
 			break
 		}
-
-		//log.Println(header)
-		//{"error": "frames from client to server must be masked"}
-		data, err := wsutil.ReadClientBinary(*recever.Conn)
-		if err != nil {
-			//延迟10秒
-			recever.OnConnErr(zap.Error(err))
-			break
+		if !started {
+			startTs, started = timestamp, true
 		}
+		recever.absTS = offsetTs + (timestamp - startTs)
+		recever.writeFLVTag(t, recever.absTS, payload)
+	}
+}
 
-		// 解码数据
-		// mask := header.Mask
-		// for i, b := range data {
-		// 	data[i] = b ^ mask[i%4]
-		// }
-		t, timestamp, payload, err := recever.ParseFLVTag(data)
-		if err != nil {
-			recever.OnConnErr(zap.Error(err))
+// 读取 fmp4 segment 解封装后发布
+func (recever *WssRecever) ReadFMP4() {
+	var startTs uint32
+	started := false
+	offsetTs := recever.absTS
+	demuxer := newFMP4Demuxer(func(t byte, timestamp uint32, payload []byte) {
+		if !started {
+			startTs, started = timestamp, true
 		}
-		if startTs == 0 {
-			startTs = timestamp
+		recever.absTS = offsetTs + (timestamp - startTs)
+		recever.writeFLVTag(t, recever.absTS, payload)
+	})
+	if err := demuxer.read(recever.reader); err != nil {
+		recever.OnConnErr(zap.Error(err))
+	}
+}
+
+// 读取 ts 解封装后发布
+func (recever *WssRecever) ReadTS() {
+	var startTs uint32
+	started := false
+	offsetTs := recever.absTS
+	demuxer := newTSDemuxer(func(t byte, timestamp uint32, payload []byte) {
+		if !started {
+			startTs, started = timestamp, true
 		}
 		recever.absTS = offsetTs + (timestamp - startTs)
+		recever.writeFLVTag(t, recever.absTS, payload)
+	})
+	if err := demuxer.read(recever.reader); err != nil {
+		recever.OnConnErr(zap.Error(err))
+	}
+}
 
-		var frame util.BLL
-
-		mem := recever.pool.Get(int(len(payload)))
-		frame.Push(mem)
-		//mem.Value = payload
-		copy(mem.Value, payload)
-		//log.Printf("type:%v, absTS:%v timestamp:%v\n", t, recever.absTS, timestamp)
-		switch t {
-		case codec.FLV_TAG_TYPE_AUDIO:
-			recever.WriteAVCCAudio(recever.absTS, &frame, recever.pool)
-		case codec.FLV_TAG_TYPE_VIDEO:
-			recever.WriteAVCCVideo(recever.absTS, &frame, recever.pool)
-		case codec.FLV_TAG_TYPE_SCRIPT:
-			recever.Info("script", zap.ByteString("data", payload))
-			//frame.Recycle()
+// 发布一个 flv tag 数据，fMP4、TS 等格式解封装后也转换为 flv tag 发布
+func (recever *WssRecever) writeFLVTag(t byte, ts uint32, payload []byte) {
+	//Enhanced FLV(HEVC/AV1/Opus)
+	if t == codec.FLV_TAG_TYPE_VIDEO && len(payload) > 0 && payload[0]&0x80 != 0 {
+		var ok bool
+		if payload, ok = normalizeEnhancedVideo(payload); !ok {
+			return
 		}
+	} else if t == codec.FLV_TAG_TYPE_AUDIO && len(payload) > 0 && payload[0]>>4 == audioFormatExHeader {
+		recever.writeEnhancedAudio(ts, payload)
+		return
+	}
+
+	// 下级平台切换主子码流时在同一路流中重发解码配置
+	if t == codec.FLV_TAG_TYPE_VIDEO && recever.VideoTrack != nil && isSequenceTag(t, payload) {
+		recever.Info("video sequence header changed", zap.Uint32("ts", ts))
+	}
+
+	atomic.StoreInt64(&recever.lastWrite, time.Now().UnixNano())
+	var frame util.BLL
+
+	mem := recever.pool.Get(int(len(payload)))
+	frame.Push(mem)
+	//mem.Value = payload
+	copy(mem.Value, payload)
+	//log.Printf("type:%v, absTS:%v timestamp:%v\n", t, recever.absTS, timestamp)
+	switch t {
+	case codec.FLV_TAG_TYPE_AUDIO:
+		recever.WriteAVCCAudio(ts, &frame, recever.pool)
+	case codec.FLV_TAG_TYPE_VIDEO:
+		recever.WriteAVCCVideo(ts, &frame, recever.pool)
+	case codec.FLV_TAG_TYPE_SCRIPT:
+		recever.Info("script", zap.ByteString("data", payload))
+		//frame.Recycle()
 	}
 }
 
 /*
 推送flv 数据
 上级平台推送接口
-ws://127.0.0.1:8450/erwscascade/wspush/cid/streampath
+ws://127.0.0.1:8450/erwscascade/wspush/{streamPath...}?cid=xx
 */
 func (p *ErWsCascadeConfig) Wspush_(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Upgrade") != "websocket" {
@@ -137,121 +208,197 @@ func (p *ErWsCascadeConfig) Wspush_(w http.ResponseWriter, r *http.Request) {
 	}
 	// 获取完整的 URL
 	fullURL := r.URL.String()
-	//判断URL编码特殊字符%2F,%2B,%3F,%25，包含这些则自动转码?= 等
 	ErWsCascadePlugin.Info("Full URL:" + fullURL)
 
-	// 获取 cid 参数
-	// 解码 URL
-	decodedURL, err := url.QueryUnescape(fullURL)
-	if err != nil {
-		ErWsCascadePlugin.Error("Error decodedURL", zap.Error(err))
-		return
-	}
-
-	// 手动解析解码后的 URL 中的参数
-	var queryString string
-	if strings.Contains(decodedURL, "?") {
-		queryString = strings.Split(decodedURL, "?")[1]
-	}
-	queryParams, err := url.ParseQuery(queryString)
-	if err != nil {
-		ErWsCascadePlugin.Error("parse query string", zap.Error(err))
-		return
+	queryParams := r.URL.Query()
+	if queryParams.Get("cid") == "" {
+		//兼容老版本: 查询参数被整体编码(%3F 等)，解码后再解析
+		decodedURL, err := url.QueryUnescape(fullURL)
+		if err != nil {
+			ErWsCascadePlugin.Error("Error decodedURL", zap.Error(err))
+			return
+		}
+		if _, queryString, found := strings.Cut(decodedURL, "?"); found {
+			if queryParams, err = url.ParseQuery(queryString); err != nil {
+				ErWsCascadePlugin.Error("parse query string", zap.Error(err))
+				return
+			}
+		}
 	}
 	cid := queryParams.Get("cid")
 	ErWsCascadePlugin.Info("wspush CID:" + cid)
 
-	// 配置WebSocket服务器选项
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
-	if err != nil {
-		ErWsCascadePlugin.Error("UpgradeHTTP error", zap.Error(err))
-		return
-	}
-
 	if cid == "" {
 		ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("invalid cid refuse connect")))
-		conn.Close()
+		http.Error(w, "invalid cid", http.StatusBadRequest)
 		return
 	}
 
-	//优先使用streamPath, 否则通过url 解析参数
-	// streamPath := queryParams.Get("streamPath")
-	// if streamPath == "" {
-	streamPath := ""
-	// 解析URL
-	u, err := url.Parse(r.URL.String())
-	if err != nil {
-		ErWsCascadePlugin.Error("URL 解析失败:", zap.Error(err))
-		return
+	//wspush 之后的全部路径为流名称，查询参数 streamPath 优先
+	streamPath := strings.Trim(queryParams.Get("streamPath"), "/")
+	if streamPath == "" {
+		var err error
+		if streamPath, err = parseWspushStreamPath(r.URL); err != nil {
+			ErWsCascadePlugin.Error("wspush", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 	}
-	// 获取路径
-	pathParts := strings.Split(u.Path, "/")
-	if len(pathParts) != 4 {
+	if streamPath == "" {
 		ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("invalid url path")))
-		conn.Close()
+		http.Error(w, "invalid stream path", http.StatusBadRequest)
 		return
 	}
+	ErWsCascadePlugin.Info("streamPath 值为:" + streamPath)
 
-	for i, part := range pathParts {
-		if part == "wspush" && i+1 < len(pathParts) {
-			streamPath = pathParts[i+1] + "/" + pathParts[i+2] // 获取 wspush 后面的路径
-			ErWsCascadePlugin.Info("streamPath 值为:" + streamPath)
-		}
-	}
-	//}
-	//生成客户推送的streamPath  修改添加 cid
-	newStreamPath := streamPath + "-" + cid
-
-	//read flv head
-	head, err := wsutil.ReadClientBinary(conn)
-	if err != nil {
-		ErWsCascadePlugin.Error("wspush read flv head faild", zap.Error(err))
-		conn.Close()
+	if err := p.checkClientCert(cid, r); err != nil {
+		ErWsCascadePlugin.Error("wspush client cert faild", zap.String("cid", cid), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-
-	if head[0] != 'F' || head[1] != 'L' || head[2] != 'V' {
-		ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("invalid flv head faild")))
-		conn.Close()
+	//与注册相同的签名校验，未配置 auth 时不鉴权
+	if err := p.verifyRegister(cid, r); err != nil {
+		ErWsCascadePlugin.Error("wspush auth faild", zap.String("cid", cid), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	configCopy := p.GetPublishConfig()
-	configCopy.PubAudio = head[4]&0x04 != 0
-	configCopy.PubVideo = head[4]&0x01 != 0
 
-	//读取校验自定义脚本
-	sc, err := wsutil.ReadClientBinary(conn)
+	// 配置WebSocket服务器选项，推流端声明支持 Enhanced FLV、推流应答、标准 ws 帧时在应答中确认
+	upgrader := ws.HTTPUpgrader{Header: http.Header{}}
+	if acceptEnhancedFlv(r.Header) {
+		upgrader.Header.Set(HeaderFlvFormat, flvFormatEnhanced)
+	}
+	withReply := r.Header.Get(HeaderPushReply) == pushReplyJSON
+	if withReply {
+		upgrader.Header.Set(HeaderPushReply, pushReplyJSON)
+	}
+	if r.Header.Get(HeaderWsFrame) == wsFrameStandard {
+		upgrader.Header.Set(HeaderWsFrame, wsFrameStandard)
+	}
+	conn, _, _, err := upgrader.Upgrade(r, w)
 	if err != nil {
-		ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("read FLV_TAG_TYPE_SCRIPT faild")))
-		conn.Close()
+		ErWsCascadePlugin.Error("UpgradeHTTP error", zap.Error(err))
 		return
 	}
 
-	if sc[0] != codec.FLV_TAG_TYPE_SCRIPT {
-		ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("parse FLV_TAG_TYPE_SCRIPT faild")))
-		conn.Close()
-		return
+	//按命名模板生成上级平台发布的streamPath，插件允许时推流地址参数 streamname 优先于插件配置
+	cinfo := ClientInfo{Cid: cid}
+	connectionsLock.RLock()
+	if client, ok := clientConnections[cid]; ok {
+		cinfo = client.CInfo
+		cinfo.Cid = cid
 	}
+	connectionsLock.RUnlock()
+	newStreamPath := renderStreamName(p.streamNameTemplate(cid, queryParams.Get("streamname")), cinfo, streamPath)
 
 	wssRecever := NewWssRecever(p, cid, &conn)
+	defer close(wssRecever.done)
 
-	wssRecever.Config = &configCopy
+	//级联流冲突处理，在读取媒体数据之前回复推流端；
+	//推流地址参数 collision 只对已鉴权的推流端生效，未配置 auth 时使用插件配置
+	policy := ""
+	if len(p.Auth) > 0 {
+		policy = queryParams.Get("collision")
+	}
+	old, reply := p.checkCollision(newStreamPath, cid, streamPath, policy)
+	if withReply {
+		if err := wssRecever.sendReply(reply); err != nil {
+			ErWsCascadePlugin.Error("wspush send reply", zap.Error(err))
+			conn.Close()
+			return
+		}
+	}
+	if !reply.Accept {
+		wssRecever.reject(reply)
+		conn.Close()
+		return
+	}
+	if reply.Resume {
+		//同一下级平台重连，接续原发布者
+		wssRecever.resume(old)
+	} else if old != nil {
+		ErWsCascadePlugin.Info("wspush takeover", zap.String("streamPath", newStreamPath), zap.String("cid", cid), zap.String("owner", reply.Owner))
+		old.closeAndWait(StatusPushTakenOver, "taken over by "+cid)
+	}
 
-	s := Streams.Get(newStreamPath)
-	if s == nil || s.Publisher == nil {
-		if err := ErWsCascadePlugin.Publish(newStreamPath, wssRecever); err != nil {
-			//p.Stream.Tracks =
-			ErWsCascadePlugin.Error("wspush", zap.Error(err))
+	//推流地址未指定 format 时按首部数据识别
+	wssRecever.format = parseMediaFormat(queryParams)
+	if wssRecever.format == "" {
+		head, err := wssRecever.reader.peek(8)
+		if err == nil {
+			wssRecever.format, err = sniffMediaFormat(head)
+		}
+		if err != nil {
+			ErWsCascadePlugin.Error("wspush unknown media format", zap.Error(err))
+			conn.Close()
+			return
+		}
+	}
+	ErWsCascadePlugin.Info("wspush media format", zap.String("format", wssRecever.format))
+	configCopy := p.GetPublishConfig()
+	if wssRecever.format == mediaFormatFLV {
+		//read flv head
+		flags, err := readFLVHeader(wssRecever.reader)
+		if err != nil {
+			ErWsCascadePlugin.Error("wspush read flv head faild", zap.Error(err))
+			conn.Close()
+			return
+		}
+		configCopy.PubAudio = flags&0x04 != 0
+		configCopy.PubVideo = flags&0x01 != 0
+
+		//读取自定义脚本，第三方推流端可能不发送 script tag
+		t, timestamp, payload, err := readFLVTag(wssRecever.reader)
+		if err != nil {
+			ErWsCascadePlugin.Error("wspush", zap.Error(errors.New("read first flv tag faild")))
 			conn.Close()
 			return
 		}
+		if t == codec.FLV_TAG_TYPE_SCRIPT {
+			ErWsCascadePlugin.Info("wspush script", zap.ByteString("data", payload))
+		} else {
+			wssRecever.firstTag = &flvTag{t, timestamp, payload}
+		}
+	}
+
+	// 接续或顶替时踢掉仍存在的发布者
+	configCopy.KickExist = reply.Resume || reply.Policy == collisionTakeover
+	wssRecever.Config = &configCopy
+
+	if err := ErWsCascadePlugin.Publish(newStreamPath, wssRecever); err != nil {
+		//p.Stream.Tracks =
+		ErWsCascadePlugin.Error("wspush", zap.Error(err))
+		conn.Close()
+		return
+	}
+	if !reply.Resume {
 		puber := wssRecever.GetPublisher()
 		// 老流中的音视频轨道不可再使用
 		puber.AudioTrack = nil
 		puber.VideoTrack = nil
-		//log.Println("Wspush publish tm:", wssRecever.Publisher.Stream.PublishTimeout)
 	}
+	addReceivedStream(&ReceivedStream{
+		StreamPath: newStreamPath,
+		Cid:        cid,
+		Name:       cinfo.Name,
+		Original:   streamPath,
+		recever:    wssRecever,
+	})
+	//log.Println("Wspush publish tm:", wssRecever.Publisher.Stream.PublishTimeout)
+
+	// 空闲回收，推流地址参数 idletimeout 不能超过插件配置
+	idle := limitIdleTimeout(p.IdleTimeout, queryParams.Get("idletimeout"))
+	wssRecever.Status = 1
+	go wssRecever.watchIdle(idle)
 
 	//阻塞读取数据
-	wssRecever.ReadFLVTag()
+	switch wssRecever.format {
+	case mediaFormatFMP4:
+		wssRecever.ReadFMP4()
+	case mediaFormatTS:
+		wssRecever.ReadTS()
+	default:
+		wssRecever.ReadFLVTag()
+	}
+	wssRecever.stopTalk()
 }